@@ -12,18 +12,31 @@
 package bastion
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base32"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -38,19 +51,584 @@ type Config struct {
 	// serve requests. It's passed the hash of its Ed25519 public key.
 	//
 	// AllowedBackend may be called concurrently.
+	//
+	// AllowedBackend is ignored if AdmitBackend is set. If neither is set,
+	// the backends passed to [Bastion.SetAllowedBackends] are allowed.
 	AllowedBackend func(keyHash [sha256.Size]byte) bool
 
+	// AdmitBackend is like AllowedBackend, but it also returns the policy that
+	// applies to the backend's connection, which is fixed for the lifetime of
+	// the connection.
+	//
+	// AdmitBackend (or AllowedBackend) is called during the TLS handshake of
+	// every backend connection and again when the connection is established;
+	// for every request routed to a backend that is not connected, to tell
+	// unknown backends (404) from offline ones (503); and for every connected
+	// backend by [Bastion.RecheckAllowedBackends] and every
+	// [Config.ReapInterval]. It's on the request path, so it must be cheap,
+	// and should not block or do network I/O.
+	//
+	// AdmitBackend may be called concurrently.
+	AdmitBackend func(keyHash [sha256.Size]byte) (BackendPolicy, bool)
+
+	// AuthorizeBackend, if not nil, is called during the handshake of every
+	// backend connection that was allowed by AllowedBackend or AdmitBackend,
+	// with the handshake context and the connection details. If it returns
+	// an error, the connection is rejected, and the error is logged.
+	//
+	// Unlike AllowedBackend, it's only called once per connection, so it can
+	// be used for more expensive checks, like querying an external database,
+	// or for auditing. TLS alerts can't carry a reason, so the backend only
+	// sees a generic handshake failure.
+	//
+	// AuthorizeBackend may be called concurrently.
+	AuthorizeBackend func(ctx context.Context, info BackendInfo) error
+
 	// Log is used to log backend connections and errors in forwarding requests.
 	// If nil, [log.Default] is used.
 	Log *log.Logger
+
+	// Logger, if not nil, is used instead of Log to log backend connection
+	// events as structured records. Each record has a "backend" attribute with
+	// the hex key hash of the backend, an "event" attribute (such as
+	// "connected", "rejected", "ping_failed", or "expired"), and an "err"
+	// attribute if the event was caused by an error.
+	Logger *slog.Logger
+
+	// UnusedConnectionTimeout, if not zero, is how long a backend connection
+	// may stay open without having been routed a single request. Connections
+	// that reach it are closed, as they likely belong to a backend that
+	// clients are not configured to use.
+	UnusedConnectionTimeout time.Duration
+
+	// ForwardHeadersAllowlist, if not empty, is the list of client request
+	// headers that are forwarded to backends. All other headers are dropped,
+	// except for the X-Forwarded-For, X-Forwarded-Host, and X-Forwarded-Proto
+	// headers set by the bastion.
+	ForwardHeadersAllowlist []string
+
+	// BareKeyHashAsRoot makes requests for "/<key hash>", without a trailing
+	// slash, be forwarded to the backend as requests for "/". By default, they
+	// are redirected to "/<key hash>/".
+	BareKeyHashAsRoot bool
+
+	// FaultInjector, if not nil, is called for every request routed to a
+	// backend, before it's forwarded. If it returns inject = true, the request
+	// is delayed by delay, and then if status is not zero it's failed with that
+	// status code without reaching the backend.
+	//
+	// FaultInjector is meant for testing how clients react to a slow or failing
+	// bastion, and should not be set in production. It may be called
+	// concurrently.
+	FaultInjector func(keyHash [sha256.Size]byte, r *http.Request) (delay time.Duration, status int, inject bool)
+
+	// MinBackendsForReady is the number of backends that need to be connected
+	// for [Bastion.Ready] to return true.
+	MinBackendsForReady int
+
+	// EmulateHEAD, if not nil, is called for HEAD requests routed to a backend.
+	// If it returns true, the request is forwarded as a GET request, and the
+	// response body is discarded. This is useful for backends that don't
+	// implement HEAD, at the cost of making them generate the full response.
+	//
+	// EmulateHEAD may be called concurrently.
+	EmulateHEAD func(keyHash [sha256.Size]byte) bool
+
+	// MaxLifetimeConnections, if not zero, is the total number of backend
+	// connections the bastion will accept over its lifetime. Once reached, new
+	// backend connections are rejected, and the channel returned by
+	// [Bastion.LifetimeConnectionsReached] is closed so that the caller can
+	// shut down. This is meant for sandbox and demo deployments.
+	MaxLifetimeConnections int
+
+	// ErrorFormat is the format of the bodies of error responses generated by
+	// the bastion itself, rather than by a backend.
+	ErrorFormat ErrorFormat
+
+	// ClientACL, if not nil, is called for every request routed to a backend
+	// with the IP address of the client, or nil if it can't be determined. The
+	// address is taken from the connection, unless the client address headers
+	// are trusted (see TrustForwardedHeaders and TrustedProxies), in which case
+	// it's the last address in the Forwarded header if ForwardedFormat is
+	// ForwardedFormatRFC7239, or in the X-Forwarded-For header otherwise. If
+	// it returns false, the request is rejected with a 403 Forbidden status.
+	//
+	// ClientACL may be called concurrently.
+	ClientACL func(keyHash [sha256.Size]byte, clientIP net.IP) bool
+
+	// BackendForHost, if not nil, maps the host of client requests, like
+	// "witness.example.org", to the key hash of a backend. Requests for a
+	// mapped host are routed to that backend with their whole path, so that
+	// it can be reached at "https://witness.example.org/..." rather than at
+	// "/<key hash>/...". Requests for other hosts are routed by path as usual.
+	//
+	// The host is lowercased, without port or trailing dot. The server
+	// serving the Bastion must also have a certificate for it.
+	//
+	// BackendForHost may be called concurrently.
+	BackendForHost func(host string) (keyHash [sha256.Size]byte, ok bool)
+
+	// AllowRequest, if not nil, is called for every request routed to a
+	// backend with its method and its path relative to the backend root, like
+	// "/add-checkpoint". If it returns false, the request is rejected with a
+	// 403 Forbidden status without reaching the backend. It can be used to
+	// limit third-party backends to the endpoints they are expected to serve.
+	//
+	// AllowRequest may be called concurrently.
+	AllowRequest func(keyHash [sha256.Size]byte, method, path string) bool
+
+	// RejectDelay, if not zero, is how long the bastion waits before failing
+	// the handshake of a backend connection that is not allowed, to slow down
+	// scanning of the allowed keys. The delay only holds up the rejected
+	// connection's own handshake, and it's cut short if the handshake is
+	// canceled or the bastion is shut down.
+	RejectDelay time.Duration
+
+	// ObserveRequestTiming, if not nil, is called with the timing breakdown of
+	// every request that was forwarded to a backend, once its response body
+	// is closed.
+	//
+	// ObserveRequestTiming may be called concurrently.
+	ObserveRequestTiming func(keyHash [sha256.Size]byte, r *http.Request, t RequestTiming)
+
+	// NoBackendsHandler, if not nil, serves requests for any backend while no
+	// backends at all are connected, for example to show a status page during
+	// a cold start or an outage. If nil, those requests fail like any request
+	// for a backend that is not connected.
+	NoBackendsHandler http.Handler
+
+	// OnBackendConnect, if not nil, is called after a backend connection is
+	// accepted and ready to serve requests. replaced is true if accepting it
+	// displaced a live connection of the same backend, which is then shut
+	// down: the previous connection or, if MaxConnectionsPerBackend is more
+	// than one, the oldest one. It's false if the backend had no live
+	// connection, or if the new connection was added alongside the others.
+	//
+	// OnBackendConnect may be called concurrently.
+	OnBackendConnect func(keyHash [sha256.Size]byte, replaced bool)
+
+	// OnBackendDisconnect, if not nil, is called after a backend connection
+	// accepted by the bastion is closed, with how long it was connected. Note
+	// that if a backend reconnects, OnBackendDisconnect is called for the old
+	// connection possibly after OnBackendConnect is called for the new one,
+	// so to alert on backends dropping off the bastion, check
+	// [Bastion.IsConnected] after a grace period.
+	//
+	// OnBackendDisconnect may be called concurrently.
+	OnBackendDisconnect func(keyHash [sha256.Size]byte, connected time.Duration)
+
+	// PingInterval is how long a backend connection can go without receiving
+	// any frame before the bastion sends it a PING. If zero, 15s is used.
+	PingInterval time.Duration
+
+	// PingTimeout is how long the bastion waits for a PING response before
+	// closing a backend connection, both for the PING sent when the backend
+	// connects (unless AcceptTimeout is set) and for those sent after
+	// PingInterval. If zero, 5s is used for the former and 15s for the latter.
+	//
+	// Setting PingInterval or PingTimeout too low risks tearing down healthy
+	// connections over slow or congested links.
+	PingTimeout time.Duration
+
+	// AcceptTimeout is how long a backend has, after the TLS handshake, to
+	// complete the HTTP/2 connection setup and respond to the initial PING,
+	// before the connection is abandoned. If zero, PingTimeout is used, or 5s
+	// if that's also zero.
+	AcceptTimeout time.Duration
+
+	// MaxConcurrentRequestsPerBackend, if not zero, is the maximum number of
+	// requests that can be in flight to a single backend at a time. Requests
+	// over the limit are rejected with a 429 Too Many Requests status.
+	MaxConcurrentRequestsPerBackend int
+
+	// RequestsPerSecondPerBackend, if positive, is the sustained rate of
+	// requests per second that are forwarded to a single backend, with bursts
+	// of up to RequestBurstPerBackend requests. If RequestBurstPerBackend is
+	// zero, it's RequestsPerSecondPerBackend rounded up. Requests over the
+	// limit are rejected with a 429 Too Many Requests status and a
+	// Retry-After header.
+	RequestsPerSecondPerBackend float64
+	RequestBurstPerBackend      int
+
+	// NotFoundHandler, if not nil, serves requests whose path doesn't start
+	// with a valid "/<key hash>" segment, instead of a 404 Not Found. It's
+	// not used for requests for backends that are not connected.
+	NotFoundHandler http.Handler
+
+	// MaxReconnects is how many connections a backend can open within
+	// ReconnectWindow. Once it's exceeded, further connections from that
+	// backend are rejected for ReconnectCooldown, to contain backends stuck in
+	// a crash loop. If zero, 10 is used. If negative, there is no limit.
+	MaxReconnects int
+
+	// ReconnectWindow is the window over which MaxReconnects is enforced. If
+	// zero, one minute is used.
+	ReconnectWindow time.Duration
+
+	// ReconnectCooldown is how long a backend that exceeded MaxReconnects is
+	// rejected for. If zero, ReconnectWindow is used.
+	ReconnectCooldown time.Duration
+
+	// MaxBackends, if not zero, is the maximum number of backends that can be
+	// connected at a time. Connections from further backends are rejected,
+	// while a backend that is already connected can always reconnect.
+	MaxBackends int
+
+	// RequestTimeout, if not zero, is the maximum duration of a request
+	// forwarded to a backend, including reading the response body. If the
+	// backend doesn't send the response headers in time, the client gets a 504
+	// Gateway Timeout status. Bastions fronting streaming or long-polling
+	// backends should leave it zero.
+	RequestTimeout time.Duration
+
+	// ReapInterval, if not zero, is how often the bastion checks all backend
+	// connections, dropping the ones that are closed, and shutting down the
+	// ones that have been idle for longer than IdleTimeout.
+	ReapInterval time.Duration
+
+	// IdleTimeout, if not zero, is how long a backend connection may go without
+	// being routed a request before it's shut down. It's enforced every
+	// ReapInterval, and ignored if ReapInterval is zero.
+	IdleTimeout time.Duration
+
+	// TrustForwardedHeaders makes the bastion extend the X-Forwarded-For
+	// header sent by the client (or the Forwarded header, depending on
+	// ForwardedFormat), instead of replacing it. By default, the Forwarded,
+	// X-Forwarded-For, X-Forwarded-Host, and X-Forwarded-Proto headers sent by
+	// the client are dropped, and backends only see the bastion's view of the
+	// request, since otherwise any client could spoof its address. It should
+	// only be set if the bastion is reachable exclusively through a trusted
+	// proxy that sets X-Forwarded-For itself.
+	TrustForwardedHeaders bool
+
+	// TrustedProxies, if not empty, are the address ranges of proxies in front
+	// of the bastion, such as a load balancer. Client address headers sent by
+	// those proxies are extended, as if TrustForwardedHeaders was set, while
+	// those sent by any other client are dropped.
+	TrustedProxies []netip.Prefix
+
+	// ForwardedFormat selects the headers that tell backends the client
+	// address. By default, the X-Forwarded-For, X-Forwarded-Host, and
+	// X-Forwarded-Proto headers are set.
+	ForwardedFormat ForwardedFormat
+
+	// DisableIdentityHeaders stops the bastion from setting the identity
+	// headers. By default, responses to clients carry an X-Bastion-Backend
+	// header with the hex key hash of the backend that served them, and
+	// requests forwarded to backends carry these headers:
+	//
+	//   - X-Bastion-Client-Key-Hash, the hex SHA-256 hash of the
+	//     SubjectPublicKeyInfo of the TLS client certificate, if the client
+	//     presented one;
+	//   - X-Bastion-Client-TLS-Version, like "TLS 1.3", if the client
+	//     connected over TLS;
+	//   - X-Bastion-Client-Protocol, the client's HTTP version, like "HTTP/2.0".
+	//
+	// Request headers with those names sent by the client are always dropped.
+	DisableIdentityHeaders bool
+
+	// FlushInterval is the flush interval to flush to the client while
+	// copying the response body, as in [httputil.ReverseProxy.FlushInterval].
+	// If negative, the response is flushed immediately after each write.
+	// Streaming responses, such as server-sent events or responses of unknown
+	// length, are always flushed immediately.
+	FlushInterval time.Duration
+
+	// FlushImmediately, if not nil, is called for every request forwarded to
+	// a backend, and if it returns true the response is flushed to the client
+	// after each write regardless of FlushInterval, for example for long-poll
+	// endpoints that send a Content-Length. r.URL.Path is relative to the
+	// backend root.
+	//
+	// FlushImmediately may be called concurrently.
+	FlushImmediately func(keyHash [sha256.Size]byte, r *http.Request) bool
+
+	// MaxReadFrameSize, if not zero, is the largest HTTP/2 frame the bastion
+	// advertises it's willing to read from backends, between 16KiB and 16MiB.
+	// Larger frames can improve throughput for large responses, like tiles.
+	// If zero, the HTTP/2 default of 16KiB is used.
+	//
+	// The connection and stream flow control windows are not configurable,
+	// but they already default to 1GiB and 4MiB respectively.
+	MaxReadFrameSize uint32
+
+	// ErrorHandler, if not nil, is called instead of the default handler when a
+	// request could not be forwarded to a connected backend, for example
+	// because the connection broke or [Config.RequestTimeout] expired (in which
+	// case err wraps [context.DeadlineExceeded]). By default, the error is
+	// logged and a 502 Bad Gateway or 504 Gateway Timeout status is returned.
+	//
+	// ErrorHandler is not called for the errors generated by the bastion
+	// itself, like those for invalid paths or for backends that are not
+	// connected, which are formatted according to ErrorFormat.
+	ErrorHandler func(http.ResponseWriter, *http.Request, error)
+
+	// MaxRequestBodyBytes, if not zero, is the maximum size of a request body
+	// forwarded to a backend. Requests that declare a larger Content-Length
+	// are rejected with a 413 Content Too Large status without being
+	// forwarded, while streamed bodies are cut off once they exceed it.
+	// [BackendPolicy.MaxRequestBodyBytes] can override it per backend.
+	MaxRequestBodyBytes int64
+
+	// Protocols is the list of bastion protocol ALPN identifiers accepted from
+	// backends, in order of preference. If empty, only [DefaultProtocol] is
+	// accepted. Connections offering only other "bastion/" protocols are
+	// rejected during the handshake.
+	//
+	// Each protocol must be implemented by this package, or [New] returns an
+	// error. Currently, that's only [DefaultProtocol].
+	Protocols []string
+
+	// RewriteRequest, if not nil, is called for every request forwarded to a
+	// backend, after the bastion has rewritten it: by then, pr.Out has the
+	// "/<key hash>" prefix stripped from the path, the client headers filtered
+	// according to ForwardHeadersAllowlist, and the X-Forwarded headers set.
+	// It may modify pr.Out further, for example to change the path or to add
+	// headers. The backend key hash is available from [BackendFromContext].
+	//
+	// Changes to pr.Out.URL.Scheme and pr.Out.Host are overwritten, since
+	// they are required to route the request over the backend connection.
+	RewriteRequest func(pr *httputil.ProxyRequest)
+
+	// AuthorizeRequest, if not nil, is called at the start of ServeHTTP, before
+	// the key hash is parsed from the path, to authorize client requests. If
+	// it returns an error, the request is not forwarded, and it's rejected
+	// with a 403 Forbidden status, or with a 401 Unauthorized status if the
+	// error wraps [ErrUnauthorized].
+	//
+	// It can be used to require a bearer token or a TLS client certificate
+	// from clients of a private bastion. It's unrelated to backend
+	// authentication.
+	AuthorizeRequest func(*http.Request) error
+
+	// AccessLog, if not nil, is used to log one line for every request
+	// forwarded to a backend, with the backend key hash, the method, the path
+	// as forwarded to the backend, the response status, the number of response
+	// body bytes, and the time it took to serve the request.
+	AccessLog *log.Logger
+
+	// AccessLogger, if not nil, is like AccessLog, but it logs a structured
+	// "request" record at the Info level for every request, with the
+	// attributes listed in AccessLogFields. It's independent of Logger, so
+	// for example access logs can be emitted as JSON with
+	// [slog.NewJSONHandler] while lifecycle events are logged as text.
+	AccessLogger *slog.Logger
+
+	// AccessLogFields is the list of attributes of AccessLogger records, in
+	// order. The available fields are "backend" (the hex-encoded key hash),
+	// "method", "path", "status", "bytes", "duration", "remote_addr",
+	// "client_ip" (the client address, taken from the forwarding headers if
+	// TrustForwardedHeaders applies), and "request_id" (only logged if
+	// RequestID is set). If empty, all fields except "client_ip" are logged.
+	// [New] returns an error for unknown fields.
+	AccessLogFields []string
+
+	// RequestID makes the bastion tag every request forwarded to a backend
+	// with a request ID, in the RequestIDHeader header. If the client request
+	// already has that header, its value is preserved, otherwise a random ID
+	// is generated. The request ID is included in the AccessLog and in logs
+	// about failures to forward the request.
+	RequestID bool
+
+	// RequestIDHeader is the header used for RequestID. If empty,
+	// X-Request-Id is used.
+	RequestIDHeader string
+
+	// PathPrefix, if not empty, is a path prefix, like "/bastion", that
+	// requests must start with. It's stripped before parsing the key hash, so
+	// backends are reachable at "<PathPrefix>/<key hash>/". Requests that don't
+	// start with it are handled like other invalid paths.
+	PathPrefix string
+
+	// ReplacedConnectionDrainTimeout is how long a connection that is shut
+	// down gracefully is given to complete its in-flight requests, before it's
+	// closed. That's the previous connection of a backend that reconnected, or
+	// a connection that reached MaxConnectionAge or IdleTimeout. If zero, 60s
+	// is used.
+	ReplacedConnectionDrainTimeout time.Duration
+
+	// MaxConnectionAge, if not zero, is how long a backend connection may stay
+	// open. Older connections are shut down gracefully, so that the backend
+	// reconnects and goes through the handshake checks again, for example
+	// to pick up certificate or AllowedBackend changes.
+	MaxConnectionAge time.Duration
+
+	// MaxConnectionsPerBackend is the number of connections a backend can
+	// keep open at the same time, for example from multiple replicas sharing
+	// the same key. Requests are routed to the connection with the fewest
+	// active streams. When a backend opens more connections than this, its
+	// oldest connection is shut down like a replaced one, unless
+	// RejectExcessConnections is set. If zero, one is used, so that a new
+	// connection replaces the previous one.
+	//
+	// Per-backend limits, like MaxConcurrentRequestsPerBackend, apply to all
+	// connections of a backend combined.
+	MaxConnectionsPerBackend int
+
+	// RejectExcessConnections makes handleBackend reject new connections from
+	// a backend that already has MaxConnectionsPerBackend live connections,
+	// instead of shutting down its oldest one, to protect against connection
+	// floods from a single key. A backend then can't replace a connection
+	// until the bastion notices it's closed.
+	RejectExcessConnections bool
+
+	// Collector, if not nil, is notified of backend connections and forwarded
+	// requests, for example to export per-backend metrics.
+	Collector Collector
+
+	// StatusCodeMetrics makes [Bastion.MetricsHandler] also export
+	// bastion_responses_by_code_total, counting responses by exact status
+	// code, in addition to the status classes of bastion_requests_total.
+	// Codes without a standard meaning are counted as "other", to bound the
+	// number of series. See also [StatusCodeLabel].
+	StatusCodeMetrics bool
+
+	// newClientConn, if not nil, replaces the HTTP/2 client connection setup,
+	// so that tests can exercise the pool with fake connections. The returned
+	// clientConn must close the net.Conn when it's closed.
+	newClientConn func(net.Conn) (clientConn, error)
+}
+
+// DefaultProtocol is the ALPN identifier of the bastion protocol accepted when
+// [Config.Protocols] is empty: HTTP/2 served by the backend over the TLS
+// connection it opened to the bastion.
+const DefaultProtocol = "bastion/0"
+
+// protocolHandlers maps the bastion ALPN protocols implemented by this package
+// to the TLSNextProto handler for connections that negotiated them. Future
+// revisions with incompatible framing get their own handler here.
+var protocolHandlers = map[string]func(p *backendConnectionsPool, hs *http.Server, c *tls.Conn, h http.Handler){
+	DefaultProtocol: (*backendConnectionsPool).handleBackend,
+}
+
+// ErrUnauthorized can be wrapped by errors returned by
+// [Config.AuthorizeRequest] to reject requests with a 401 Unauthorized status.
+var ErrUnauthorized = errors.New("bastion: unauthorized")
+
+// BackendPolicy is the per-backend configuration returned by
+// [Config.AdmitBackend].
+type BackendPolicy struct {
+	// Name, if not empty, is a human-readable name for the backend, which is
+	// included in log lines about it.
+	Name string
+
+	// MaxConcurrentRequests, if not zero, overrides
+	// [Config.MaxConcurrentRequestsPerBackend] for this backend. If negative,
+	// there is no limit.
+	MaxConcurrentRequests int
+
+	// RequestsPerSecond and RequestBurst, if RequestsPerSecond is not zero,
+	// override [Config.RequestsPerSecondPerBackend] and
+	// [Config.RequestBurstPerBackend] for this backend. If RequestsPerSecond
+	// is negative, there is no limit.
+	RequestsPerSecond float64
+	RequestBurst      int
+
+	// MaxRequestBodyBytes, if not zero, overrides [Config.MaxRequestBodyBytes]
+	// for this backend. If negative, there is no limit.
+	MaxRequestBodyBytes int64
+}
+
+// BackendInfo describes a backend connection being authorized by
+// [Config.AuthorizeBackend].
+type BackendInfo struct {
+	// KeyHash is the hash of the backend's Ed25519 public key.
+	KeyHash [sha256.Size]byte
+	// ConnectionState is the state of the TLS connection, including the
+	// backend's self-signed certificate.
+	ConnectionState tls.ConnectionState
+	// RemoteAddr is the network address of the backend.
+	RemoteAddr net.Addr
+}
+
+// BackendTLS are the TLS parameters negotiated by a backend connection.
+type BackendTLS struct {
+	// Version is the TLS version, such as [tls.VersionTLS13].
+	Version uint16
+	// CipherSuite is the cipher suite, such as [tls.TLS_AES_128_GCM_SHA256].
+	CipherSuite uint16
+	// NegotiatedProtocol is the bastion ALPN protocol, such as "bastion/0".
+	NegotiatedProtocol string
+}
+
+// RequestTiming is the timing breakdown of a request forwarded to a backend.
+// All durations are measured from when [Bastion.ServeHTTP] was called.
+type RequestTiming struct {
+	// Resolve is the time it took to look up the backend connection.
+	Resolve time.Duration
+	// FirstByte is the time until the response headers were received.
+	FirstByte time.Duration
+	// Total is the time until the response body was fully copied or closed.
+	Total time.Duration
 }
 
+// ErrorFormat selects the format of error responses generated by the bastion.
+type ErrorFormat int
+
+const (
+	// ErrorFormatText is a plain text message, as served by [http.Error].
+	ErrorFormatText ErrorFormat = iota
+
+	// ErrorFormatProblemJSON is an RFC 7807 application/problem+json object,
+	// with the type, title, status, and detail members.
+	ErrorFormatProblemJSON
+)
+
+// errorBody returns the Content-Type and body of an error response.
+func (f ErrorFormat) errorBody(status int, detail string) (string, []byte) {
+	switch f {
+	case ErrorFormatProblemJSON:
+		body, err := json.Marshal(struct {
+			Type   string `json:"type"`
+			Title  string `json:"title"`
+			Status int    `json:"status"`
+			Detail string `json:"detail"`
+		}{
+			Type:   "about:blank",
+			Title:  http.StatusText(status),
+			Status: status,
+			Detail: detail,
+		})
+		if err != nil {
+			panic(err) // can't happen
+		}
+		return "application/problem+json", append(body, '\n')
+	default:
+		return "text/plain; charset=utf-8", []byte(detail + "\n")
+	}
+}
+
+// ForwardedFormat selects the headers that tell backends about the client of a
+// forwarded request.
+type ForwardedFormat int
+
+const (
+	// ForwardedFormatXForwarded sets the X-Forwarded-For, X-Forwarded-Host,
+	// and X-Forwarded-Proto headers, as [httputil.ProxyRequest.SetXForwarded].
+	ForwardedFormatXForwarded ForwardedFormat = iota
+
+	// ForwardedFormatRFC7239 sets the RFC 7239 Forwarded header, with the
+	// for, host, and proto parameters.
+	ForwardedFormatRFC7239
+
+	// ForwardedFormatNone doesn't tell backends anything about the client.
+	ForwardedFormatNone
+)
+
 // A Bastion keeps track of backend connections, and serves HTTP requests by
 // routing them to the matching backend.
 type Bastion struct {
 	c     *Config
 	proxy *httputil.ReverseProxy
 	pool  *backendConnectionsPool
+
+	forwardHeaders  map[string]bool
+	requestIDHeader string
+	started         time.Time
+	paused          atomic.Bool
+
+	// allowed is the set of backends set by SetAllowedBackends.
+	allowed atomic.Pointer[map[keyHash]bool]
 }
 
 type keyHash [sha256.Size]byte
@@ -58,32 +636,301 @@ type keyHash [sha256.Size]byte
 // New returns a new Bastion.
 //
 // The Config must not be modified after the call to New.
+//
+// New is equivalent to NewWithContext with [context.Background].
 func New(c *Config) (*Bastion, error) {
-	b := &Bastion{c: c}
+	return NewWithContext(context.Background(), c)
+}
+
+// NewWithContext returns a new Bastion tied to ctx. When ctx is canceled, the
+// Bastion is shut down as if by [Bastion.Shutdown]: new backend connections
+// are rejected, and existing ones are closed once their in-flight requests
+// complete, without a deadline. To bound the wait, call Shutdown directly.
+//
+// The Config must not be modified after the call to NewWithContext.
+func NewWithContext(ctx context.Context, c *Config) (*Bastion, error) {
+	for _, f := range c.AccessLogFields {
+		if !slices.Contains(accessLogFields, f) {
+			return nil, fmt.Errorf("bastion: unknown access log field %q", f)
+		}
+	}
+	for _, proto := range c.Protocols {
+		if _, ok := protocolHandlers[proto]; !ok {
+			return nil, fmt.Errorf("bastion: unsupported protocol %q", proto)
+		}
+	}
+	b := &Bastion{c: c, started: time.Now()}
 	b.pool = &backendConnectionsPool{
-		log:   log.Default(),
-		conns: make(map[keyHash]*http2.ClientConn),
+		done:         ctx.Done(),
+		stopped:      make(chan struct{}),
+		c:            c,
+		log:          log.Default(),
+		conns:        make(map[keyHash]*backendConn),
+		replicas:     make(map[keyHash][]*backendConn),
+		buckets:      make(map[keyHash]*tokenBucket),
+		exhausted:    make(chan struct{}),
+		flaps:        make(map[keyHash]*flapState),
+		fingerprints: make(map[keyHash][sha256.Size]byte),
+		admit:        c.AdmitBackend,
 	}
 	if c.Log != nil {
 		b.pool.log = c.Log
 	}
+	b.pool.metrics.exactCodes = c.StatusCodeMetrics
+	if b.pool.admit == nil && c.AllowedBackend != nil {
+		b.pool.admit = func(kh [sha256.Size]byte) (BackendPolicy, bool) {
+			return BackendPolicy{}, c.AllowedBackend(kh)
+		}
+	}
+	if b.pool.admit == nil {
+		b.allowed.Store(&map[keyHash]bool{})
+		b.pool.admit = func(kh [sha256.Size]byte) (BackendPolicy, bool) {
+			return BackendPolicy{}, (*b.allowed.Load())[kh]
+		}
+	}
+	b.requestIDHeader = "X-Request-Id"
+	if c.RequestIDHeader != "" {
+		b.requestIDHeader = http.CanonicalHeaderKey(c.RequestIDHeader)
+	}
+	if len(c.ForwardHeadersAllowlist) > 0 {
+		b.forwardHeaders = make(map[string]bool)
+		for _, h := range c.ForwardHeadersAllowlist {
+			b.forwardHeaders[http.CanonicalHeaderKey(h)] = true
+		}
+		// These are set by the ReverseProxy itself, not by the client.
+		b.forwardHeaders["Te"] = true
+		b.forwardHeaders["Connection"] = true
+		b.forwardHeaders["Upgrade"] = true
+	}
 	b.proxy = &httputil.ReverseProxy{
-		Rewrite: func(pr *httputil.ProxyRequest) {
-			pr.Out.URL.Scheme = "https" // needed for the required :scheme header
-			pr.Out.Host = pr.In.Context().Value("backend").(string)
-			pr.SetXForwarded()
-			// We don't interpret the query, so pass it on unmodified.
-			pr.Out.URL.RawQuery = pr.In.URL.RawQuery
-		},
-		Transport: b.pool,
-		ErrorLog:  c.Log,
+		Rewrite:       b.rewrite,
+		Transport:     b.pool,
+		ErrorLog:      c.Log,
+		ErrorHandler:  b.proxyError,
+		FlushInterval: c.FlushInterval,
+		BufferPool:    proxyBufferPool,
+	}
+	if !c.DisableIdentityHeaders {
+		// ServeHTTP sets X-Bastion-Backend before forwarding the request, so
+		// that it's also present on errors. Don't let backends add another.
+		b.proxy.ModifyResponse = func(resp *http.Response) error {
+			resp.Header.Del("X-Bastion-Backend")
+			return nil
+		}
+	}
+	// Start the background work only once the pool is fully set up, since
+	// the reaper calls p.admit.
+	if c.ReapInterval != 0 {
+		go b.pool.reaper()
 	}
+	context.AfterFunc(ctx, func() {
+		b.pool.shutdown(context.Background())
+	})
 	return b, nil
 }
 
+// proxyBufferPool is shared by the ReverseProxy of all Bastions, to avoid
+// allocating a new buffer to copy every response body.
+var proxyBufferPool = &bufferPool{}
+
+// bufferPool is an httputil.BufferPool of 32KiB buffers, the size that
+// ReverseProxy allocates when it has no BufferPool.
+type bufferPool struct {
+	p sync.Pool
+}
+
+func (bp *bufferPool) Get() []byte {
+	if b, ok := bp.p.Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, 32*1024)
+}
+
+func (bp *bufferPool) Put(b []byte) {
+	if cap(b) != 32*1024 {
+		return
+	}
+	b = b[:cap(b)]
+	bp.p.Put(&b)
+}
+
+// proxyError handles errors returned by the pool or by a backend connection,
+// with Config.ErrorHandler if set, or like the default ReverseProxy
+// ErrorHandler, but formatting the response according to Config.ErrorFormat.
+func (b *Bastion) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if b.c.ErrorHandler != nil {
+		b.serveSynthesized(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b.c.ErrorHandler(w, r, err)
+		}), w, r, "backend_error")
+		return
+	}
+	requestID, _ := r.Context().Value(requestIDContextKey{}).(string)
+	if kh, ok := BackendFromContext(r.Context()); ok && b.c.Logger != nil {
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.EscapedPath()),
+			slog.String("remote_addr", r.RemoteAddr),
+		}
+		if requestID != "" {
+			attrs = append(attrs, slog.String("request_id", requestID))
+		}
+		b.pool.logEventAttrs(kh, "proxy_error", err, attrs, "error forwarding request")
+	} else if requestID != "" {
+		b.pool.log.Printf("http: proxy error (request %s): %v", requestID, err)
+	} else {
+		b.pool.log.Printf("http: proxy error: %v", err)
+	}
+	if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+		b.writeError(w, r, http.StatusRequestEntityTooLarge, "body_too_large", "request body too large")
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) && b.c.RequestTimeout != 0 {
+		b.writeError(w, r, http.StatusGatewayTimeout, "timeout", "backend did not respond in time")
+		return
+	}
+	b.writeError(w, r, http.StatusBadGateway, "backend_error", "error forwarding request to backend")
+}
+
+// writeError writes an error response generated by the bastion for r, and
+// counts it with the given reason.
+func (b *Bastion) writeError(w http.ResponseWriter, r *http.Request, status int, reason, detail string) {
+	b.pool.synthesized(r.Context(), status, reason)
+	contentType, body := b.c.ErrorFormat.errorBody(status, detail)
+	h := w.Header()
+	// Like http.Error, delete headers that might have been set for a different
+	// response, and that would not make sense for this one.
+	h.Del("Content-Length")
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (b *Bastion) rewrite(pr *httputil.ProxyRequest) {
+	pr.Out.URL.Scheme = "https" // needed for the required :scheme header
+	kh, _ := BackendFromContext(pr.In.Context())
+	pr.Out.Host = hex.EncodeToString(kh[:])
+	if b.forwardHeaders != nil {
+		for name := range pr.Out.Header {
+			if !b.forwardHeaders[name] {
+				pr.Out.Header.Del(name)
+			}
+		}
+	}
+	// ReverseProxy already drops these before calling Rewrite, but be explicit
+	// since backends might rely on them for access control.
+	pr.Out.Header.Del("X-Forwarded-For")
+	pr.Out.Header.Del("X-Forwarded-Host")
+	pr.Out.Header.Del("X-Forwarded-Proto")
+	pr.Out.Header.Del("Forwarded")
+	pr.Out.Header.Del("X-Bastion-Client-Key-Hash")
+	pr.Out.Header.Del("X-Bastion-Client-Tls-Version")
+	pr.Out.Header.Del("X-Bastion-Client-Protocol")
+	if !b.c.DisableIdentityHeaders {
+		setIdentityHeaders(pr)
+	}
+	switch b.c.ForwardedFormat {
+	case ForwardedFormatXForwarded:
+		if b.trustForwarded(pr.In) {
+			pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+		}
+		pr.SetXForwarded()
+	case ForwardedFormatRFC7239:
+		if b.trustForwarded(pr.In) {
+			pr.Out.Header["Forwarded"] = pr.In.Header["Forwarded"]
+		}
+		setForwarded(pr)
+	}
+	if id, ok := pr.In.Context().Value(requestIDContextKey{}).(string); ok {
+		pr.Out.Header.Set(b.requestIDHeader, id)
+	}
+	// We don't interpret the query, so pass it on unmodified.
+	pr.Out.URL.RawQuery = pr.In.URL.RawQuery
+	if b.c.RewriteRequest != nil {
+		b.c.RewriteRequest(pr)
+		pr.Out.URL.Scheme = "https"
+		pr.Out.Host = hex.EncodeToString(kh[:])
+	}
+}
+
+// setIdentityHeaders sets the X-Bastion-Client headers on pr.Out, describing
+// the client connection of pr.In.
+func setIdentityHeaders(pr *httputil.ProxyRequest) {
+	if cs := pr.In.TLS; cs != nil {
+		if len(cs.PeerCertificates) > 0 {
+			h := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			pr.Out.Header.Set("X-Bastion-Client-Key-Hash", hex.EncodeToString(h[:]))
+		}
+		pr.Out.Header.Set("X-Bastion-Client-Tls-Version", tls.VersionName(cs.Version))
+	}
+	pr.Out.Header.Set("X-Bastion-Client-Protocol", pr.In.Proto)
+}
+
+// trustForwarded returns whether the client address headers of r can be
+// trusted, according to TrustForwardedHeaders and TrustedProxies.
+func (b *Bastion) trustForwarded(r *http.Request) bool {
+	if b.c.TrustForwardedHeaders {
+		return true
+	}
+	if len(b.c.TrustedProxies) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := addr.Addr().Unmap()
+	return slices.ContainsFunc(b.c.TrustedProxies, func(p netip.Prefix) bool {
+		return p.Contains(ip)
+	})
+}
+
+// setForwarded appends an RFC 7239 Forwarded element for this hop to pr.Out,
+// like SetXForwarded does for the X-Forwarded headers.
+func setForwarded(pr *httputil.ProxyRequest) {
+	var elem []string
+	if addr, err := netip.ParseAddrPort(pr.In.RemoteAddr); err == nil {
+		ip := addr.Addr().Unmap()
+		if ip.Is6() {
+			elem = append(elem, `for="[`+ip.String()+`]"`)
+		} else {
+			elem = append(elem, "for="+ip.String())
+		}
+	}
+	if pr.In.Host != "" {
+		elem = append(elem, "host="+forwardedValue(pr.In.Host))
+	}
+	if pr.In.TLS != nil {
+		elem = append(elem, "proto=https")
+	} else {
+		elem = append(elem, "proto=http")
+	}
+	value := strings.Join(elem, ";")
+	if prior := pr.Out.Header.Values("Forwarded"); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	pr.Out.Header.Set("Forwarded", value)
+}
+
+// forwardedValue returns s as an RFC 7239 value, quoting it unless it's a
+// token.
+func forwardedValue(s string) string {
+	for _, c := range []byte(s) {
+		if !isTokenChar(c) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func isTokenChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
 // ConfigureServer sets up srv to handle backend connections to the bastion. It
 // wraps TLSConfig.GetConfigForClient to intercept backend connections, and sets
-// TLSNextProto for the bastion ALPN protocol. The original tls.Config is still
+// TLSNextProto for the bastion ALPN protocols. The original tls.Config is still
 // used for non-bastion backend connections.
 //
 // Note that since TLSNextProto won't be nil after a call to ConfigureServer,
@@ -92,24 +939,18 @@ func (b *Bastion) ConfigureServer(srv *http.Server) error {
 	if srv.TLSNextProto == nil {
 		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 	}
-	srv.TLSNextProto["bastion/0"] = b.pool.handleBackend
+	protocols := b.protocols()
+	for _, proto := range protocols {
+		handle := protocolHandlers[proto]
+		srv.TLSNextProto[proto] = func(hs *http.Server, c *tls.Conn, h http.Handler) {
+			handle(b.pool, hs, c, h)
+		}
+	}
 
 	bastionTLSConfig := &tls.Config{
-		MinVersion: tls.VersionTLS13,
-		NextProtos: []string{"bastion/0"},
-		ClientAuth: tls.RequireAnyClientCert,
-		VerifyConnection: func(cs tls.ConnectionState) error {
-			leaf := cs.PeerCertificates[0]
-			pk, ok := leaf.PublicKey.(ed25519.PublicKey)
-			if !ok {
-				return errors.New("self-signed certificate key type is not Ed25519")
-			}
-			h := sha256.Sum256(pk)
-			if !b.c.AllowedBackend(h) {
-				return fmt.Errorf("unrecognized backend %x", h)
-			}
-			return nil
-		},
+		MinVersion:     tls.VersionTLS13,
+		NextProtos:     protocols,
+		ClientAuth:     tls.RequireAnyClientCert,
 		GetCertificate: b.c.GetCertificate,
 	}
 
@@ -119,9 +960,19 @@ func (b *Bastion) ConfigureServer(srv *http.Server) error {
 	oldGetConfigForClient := srv.TLSConfig.GetConfigForClient
 	srv.TLSConfig.GetConfigForClient = func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
 		for _, proto := range chi.SupportedProtos {
-			if proto == "bastion/0" {
-				// This is a bastion connection from a backend.
-				return bastionTLSConfig, nil
+			if slices.Contains(protocols, proto) {
+				// This is a bastion connection from a backend. Bind the
+				// handshake context and remote address.
+				cfg := bastionTLSConfig.Clone()
+				cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+					return b.verifyConnection(chi.Context(), chi.Conn.RemoteAddr(), cs)
+				}
+				return cfg, nil
+			}
+		}
+		for _, proto := range chi.SupportedProtos {
+			if strings.HasPrefix(proto, "bastion/") {
+				return nil, fmt.Errorf("unsupported bastion protocol %q", proto)
 			}
 		}
 		if oldGetConfigForClient != nil {
@@ -133,85 +984,1923 @@ func (b *Bastion) ConfigureServer(srv *http.Server) error {
 	return nil
 }
 
-// ServeHTTP serves requests rooted at "/<hex key hash>/" by routing them to the
-// backend that authenticated with that key. Other requests are served a 404 Not
-// Found status.
-func (b *Bastion) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path
-	if !strings.HasPrefix(path, "/") {
-		http.Error(w, "request must start with /KEY_HASH/", http.StatusNotFound)
-		return
+// verifyConnection checks the handshake of a backend connection with
+// verifyBackend and, if set, Config.AuthorizeBackend. Connections that fail
+// verifyBackend are held for RejectDelay, unless the handshake context is
+// canceled or the bastion shuts down first.
+func (b *Bastion) verifyConnection(ctx context.Context, remote net.Addr, cs tls.ConnectionState) error {
+	if err := b.verifyBackend(cs); err != nil {
+		b.pool.metrics.rejected.Add(1)
+		if b.c.RejectDelay > 0 {
+			t := time.NewTimer(b.c.RejectDelay)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+			case <-b.pool.done:
+			case <-b.pool.stopped:
+			}
+		}
+		return err
 	}
-	path = path[1:]
-	kh, path, ok := strings.Cut(path, "/")
-	if !ok {
-		http.Error(w, "request must start with /KEY_HASH/", http.StatusNotFound)
-		return
+	if b.c.AuthorizeBackend != nil {
+		return b.authorizeBackend(ctx, remote, cs)
 	}
-	ctx := context.WithValue(r.Context(), "backend", kh)
-	r = r.Clone(ctx)
-	r.URL.Path = "/" + path
-	b.proxy.ServeHTTP(w, r)
+	return nil
 }
 
-type backendConnectionsPool struct {
-	log *log.Logger
-	sync.RWMutex
-	conns map[keyHash]*http2.ClientConn
+// protocols returns the bastion ALPN protocols accepted from backends.
+func (b *Bastion) protocols() []string {
+	if len(b.c.Protocols) == 0 {
+		return []string{DefaultProtocol}
+	}
+	return b.c.Protocols
 }
 
-func (p *backendConnectionsPool) RoundTrip(r *http.Request) (*http.Response, error) {
-	kh, err := hex.DecodeString(r.Host)
-	if err != nil || len(kh) != sha256.Size {
-		// TODO: return this as a response instead.
-		return nil, errors.New("invalid backend key hash")
+func (b *Bastion) verifyBackend(cs tls.ConnectionState) error {
+	pk, err := backendKey(cs)
+	if err != nil {
+		return err
 	}
-	p.RLock()
-	cc, ok := p.conns[keyHash(kh)]
-	p.RUnlock()
-	if !ok {
-		// TODO: return this as a response instead.
-		return nil, errors.New("backend unavailable")
+	leaf := cs.PeerCertificates[0]
+	if err := leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature); err != nil {
+		return fmt.Errorf("certificate is not self-signed by its Ed25519 key: %w", err)
 	}
-	return cc.RoundTrip(r)
+	h := sha256.Sum256(pk)
+	if _, ok := b.pool.admit(h); !ok {
+		return fmt.Errorf("unrecognized backend %x", h)
+	}
+	return nil
 }
 
-func (p *backendConnectionsPool) handleBackend(hs *http.Server, c *tls.Conn, h http.Handler) {
-	backend := sha256.Sum256(c.ConnectionState().PeerCertificates[0].PublicKey.(ed25519.PublicKey))
-	t := &http2.Transport{
-		// Send a PING every 15s, with the default 15s timeout.
-		ReadIdleTimeout: 15 * time.Second,
+// authorizeBackend calls Config.AuthorizeBackend for a backend connection that
+// passed verifyBackend.
+func (b *Bastion) authorizeBackend(ctx context.Context, remote net.Addr, cs tls.ConnectionState) error {
+	pk, err := backendKey(cs)
+	if err != nil {
+		return err
 	}
-	cc, err := t.NewClientConn(c)
+	kh := sha256.Sum256(pk)
+	err = b.c.AuthorizeBackend(ctx, BackendInfo{KeyHash: kh, ConnectionState: cs, RemoteAddr: remote})
 	if err != nil {
-		p.log.Printf("%x: failed to convert to HTTP/2 client connection: %v", backend, err)
-		return
+		b.pool.metrics.rejected.Add(1)
+		b.pool.logEventAttrs(kh, "rejected", err, []slog.Attr{slog.String("remote_addr", remote.String())},
+			"backend connection from %v not authorized", remote)
+		return fmt.Errorf("backend %x not authorized: %w", kh, err)
 	}
+	return nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := cc.Ping(ctx); err != nil {
-		p.log.Printf("%x: did not respond to PING: %v", backend, err)
-		return
+// backendKey returns the Ed25519 public key of the leaf certificate presented
+// by a backend, or an error if the chain is empty or the key is not Ed25519.
+func backendKey(cs tls.ConnectionState) (ed25519.PublicKey, error) {
+	if len(cs.PeerCertificates) == 0 || cs.PeerCertificates[0] == nil {
+		return nil, errors.New("missing client certificate")
 	}
+	pk, ok := cs.PeerCertificates[0].PublicKey.(ed25519.PublicKey)
+	if !ok || len(pk) != ed25519.PublicKeySize {
+		return nil, errors.New("self-signed certificate key type is not Ed25519")
+	}
+	return pk, nil
+}
 
-	p.Lock()
-	if oldCC, ok := p.conns[backend]; ok && !oldCC.State().Closed {
-		go func() {
-			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-			defer cancel()
-			oldCC.Shutdown(ctx)
+// ServeHTTP serves requests rooted at "/<key hash>/" by routing them to the
+// backend that authenticated with that key. The key hash may be encoded in hex
+// or in unpadded base32. Requests for "/<key hash>" are redirected or routed
+// according to [Config.BareKeyHashAsRoot]. Other requests are served by
+// [Config.NotFoundHandler], or a 404 Not Found status. Requests for hosts
+// mapped by [Config.BackendForHost] are instead routed to that backend
+// regardless of their path.
+//
+// The accepted paths, after [Config.PathPrefix], are
+//
+//	["/v" <N>] "/" <key hash> ["/" <backend path>]
+//
+// where N is a decimal protocol version without leading zeroes. With a version
+// segment, like "/v0/<key hash>/", the request is only routed to connections
+// of the backend that negotiated the "bastion/<N>" protocol, and it fails with
+// a 404 Not Found status if that protocol is not in [Config.Protocols].
+//
+// Requests for backends that are not allowed to connect fail with a 404 Not
+// Found status, while requests for allowed backends that are not connected
+// fail with a 503 Service Unavailable status and a Retry-After header.
+func (b *Bastion) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if b.c.AuthorizeRequest != nil {
+		if err := b.c.AuthorizeRequest(r); errors.Is(err, ErrUnauthorized) {
+			b.writeError(w, r, http.StatusUnauthorized, "unauthorized", "client request not authorized")
+			return
+		} else if err != nil {
+			b.writeError(w, r, http.StatusForbidden, "unauthorized", "client request not authorized")
+			return
+		}
+	}
+	rt, notFound := b.route(r)
+	if notFound != "" {
+		b.notFound(w, r, notFound)
+		return
+	}
+	kh, path, slash, protocol := rt.backend, rt.path, rt.slash, rt.protocol
+	// rw is the underlying ResponseWriter, for http.MaxBytesReader.
+	rw := w
+	var sw *statusWriter
+	if b.c.Collector != nil {
+		ro := &responseOrigin{}
+		r = r.WithContext(context.WithValue(r.Context(), responseOriginContextKey{}, ro))
+		// Report every response for a backend, including those generated
+		// before the request is forwarded, like rejections and redirects.
+		var body *countingReader
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingReader{ReadCloser: r.Body}
+			r.Body = body
+		}
+		sw = &statusWriter{ResponseWriter: w}
+		w = sw
+		defer func() {
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			var bytesIn int64
+			if body != nil {
+				bytesIn = body.n.Load()
+			}
+			b.c.Collector.RequestCompleted(kh, status, ro.reason, bytesIn, sw.bytes)
 		}()
 	}
-	p.conns[backend] = cc
-	p.Unlock()
-
-	p.log.Printf("%x: accepted new backend connection", backend)
-	// We need not to return, or http.Server will close this connection. There
-	// is no way to wait for the ClientConn's closing, so we poll. We could
-	// switch this to a Server.ConnState callback with some plumbing.
-	for !cc.State().Closed {
-		time.Sleep(1 * time.Second)
+	if b.paused.Load() {
+		b.writeError(w, r, http.StatusServiceUnavailable, "paused", "bastion is paused")
+		return
+	}
+	if b.c.NoBackendsHandler != nil && b.pool.empty() {
+		b.serveSynthesized(b.c.NoBackendsHandler, w, r, "no_backends")
+		return
+	}
+	if b.c.ClientACL != nil && !b.c.ClientACL(kh, b.clientIP(r)) {
+		b.writeError(w, r, http.StatusForbidden, "client_acl", "client not allowed to reach backend")
+		return
+	}
+	if !slash && !b.c.BareKeyHashAsRoot {
+		target := r.URL.EscapedPath() + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		// Use 308 rather than 301 so that clients don't turn POSTs into GETs.
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+		b.pool.synthesized(r.Context(), http.StatusPermanentRedirect, "redirect")
+		return
+	}
+	if b.c.AllowRequest != nil && !b.c.AllowRequest(kh, r.Method, "/"+path) {
+		b.writeError(w, r, http.StatusForbidden, "request_not_allowed", "request not allowed for backend")
+		return
+	}
+	limit := b.c.MaxRequestBodyBytes
+	if policy, ok := b.pool.policy(kh); ok && policy.MaxRequestBodyBytes != 0 {
+		limit = policy.MaxRequestBodyBytes
+	}
+	if limit > 0 && r.ContentLength != 0 {
+		if r.ContentLength > limit {
+			b.writeError(w, r, http.StatusRequestEntityTooLarge, "body_too_large", "request body too large")
+			return
+		}
+		r.Body = http.MaxBytesReader(rw, r.Body, limit)
+	}
+	ctx := r.Context()
+	if b.c.RequestTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.c.RequestTimeout)
+		defer cancel()
+	}
+	ctx = context.WithValue(ctx, backendContextKey{}, kh)
+	ctx = context.WithValue(ctx, startContextKey{}, start)
+	if protocol != "" {
+		ctx = context.WithValue(ctx, protocolContextKey{}, protocol)
+	}
+	var requestID string
+	if b.c.RequestID {
+		requestID = r.Header.Get(b.requestIDHeader)
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		ctx = context.WithValue(ctx, requestIDContextKey{}, requestID)
+	}
+	r = r.Clone(ctx)
+	r.URL.Path = "/" + path
+	if !b.c.DisableIdentityHeaders {
+		w.Header().Set("X-Bastion-Backend", hex.EncodeToString(kh[:]))
+	}
+	if b.c.FlushImmediately != nil && b.c.FlushImmediately(kh, r) {
+		w = &flushWriter{ResponseWriter: w}
+	}
+	if b.c.AccessLog == nil && b.c.AccessLogger == nil {
+		b.proxy.ServeHTTP(w, r)
+		return
+	}
+	if sw == nil {
+		sw = &statusWriter{ResponseWriter: w}
+		w = sw
+	}
+	b.proxy.ServeHTTP(w, r)
+	status := sw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	duration := time.Since(start)
+	if b.c.AccessLogger != nil {
+		fields := b.c.AccessLogFields
+		if len(fields) == 0 {
+			fields = defaultAccessLogFields
+		}
+		attrs := make([]slog.Attr, 0, len(fields))
+		for _, f := range fields {
+			switch f {
+			case "backend":
+				attrs = append(attrs, slog.String(f, hex.EncodeToString(kh[:])))
+			case "method":
+				attrs = append(attrs, slog.String(f, r.Method))
+			case "path":
+				attrs = append(attrs, slog.String(f, r.URL.EscapedPath()))
+			case "status":
+				attrs = append(attrs, slog.Int(f, status))
+			case "bytes":
+				attrs = append(attrs, slog.Int64(f, sw.bytes))
+			case "duration":
+				attrs = append(attrs, slog.Duration(f, duration))
+			case "remote_addr":
+				attrs = append(attrs, slog.String(f, r.RemoteAddr))
+			case "client_ip":
+				if ip := b.clientIP(r); ip != nil {
+					attrs = append(attrs, slog.String(f, ip.String()))
+				}
+			case "request_id":
+				if requestID != "" {
+					attrs = append(attrs, slog.String(f, requestID))
+				}
+			}
+		}
+		b.c.AccessLogger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	}
+	if b.c.AccessLog == nil {
+		return
+	}
+	line := fmt.Sprintf("%x %s %s %d %d %v", kh, r.Method, r.URL.EscapedPath(),
+		status, sw.bytes, duration.Round(time.Microsecond))
+	if requestID != "" {
+		line += " " + requestID
+	}
+	b.c.AccessLog.Print(line)
+}
+
+// accessLogFields are the fields supported by Config.AccessLogFields, and
+// defaultAccessLogFields are the ones logged if it's empty.
+var accessLogFields = []string{"backend", "method", "path", "status", "bytes",
+	"duration", "remote_addr", "client_ip", "request_id"}
+var defaultAccessLogFields = []string{"backend", "method", "path", "status",
+	"bytes", "duration", "remote_addr", "request_id"}
+
+// route is the result of resolving a request to a backend.
+type route struct {
+	backend keyHash
+	// path is the request path relative to the backend root, without the
+	// leading slash, and slash is whether there was a slash after the key hash.
+	path  string
+	slash bool
+	// protocol is the bastion protocol selected by a version path segment.
+	protocol string
+}
+
+// route resolves the backend a request is for, as described in ServeHTTP. If
+// the request doesn't name a backend, it returns the reason why.
+func (b *Bastion) route(r *http.Request) (rt route, notFound string) {
+	kh, path, slash, ok := b.hostBackend(r)
+	if ok {
+		return route{backend: kh, path: path, slash: slash}, ""
+	}
+	path = r.URL.Path
+	prefix := strings.TrimSuffix(b.c.PathPrefix, "/")
+	if !strings.HasPrefix(path, prefix+"/") {
+		return route{}, "request must start with " + prefix + "/KEY_HASH/"
+	}
+	path = path[len(prefix):]
+	var khSegment string
+	khSegment, path, slash = strings.Cut(path[1:], "/")
+	var protocol string
+	if proto, ok := versionProtocol(khSegment); ok {
+		if !slices.Contains(b.protocols(), proto) {
+			return route{}, "unsupported protocol version"
+		}
+		protocol = proto
+		khSegment, path, slash = strings.Cut(path, "/")
+	}
+	kh, ok = parseKeyHash(khSegment)
+	if !ok {
+		return route{}, "invalid backend key hash"
+	}
+	return route{backend: kh, path: path, slash: slash, protocol: protocol}, ""
+}
+
+// BackendForRequest returns the hash of the Ed25519 public key of the backend
+// that [Bastion.ServeHTTP] would route r to, based on its path or host, or
+// false if r doesn't name a backend. It doesn't check whether the backend is
+// allowed or connected.
+//
+// Middleware wrapping ServeHTTP can use it to apply per-backend logic without
+// parsing the path, since [BackendFromContext] only works with the requests
+// that ServeHTTP forwards.
+func (b *Bastion) BackendForRequest(r *http.Request) ([sha256.Size]byte, bool) {
+	rt, notFound := b.route(r)
+	return rt.backend, notFound == ""
+}
+
+// hostBackend returns the backend that Config.BackendForHost maps the request
+// host to, if any, and the request path relative to the backend root, without
+// the leading slash.
+func (b *Bastion) hostBackend(r *http.Request) (kh keyHash, path string, slash, ok bool) {
+	if b.c.BackendForHost == nil {
+		return keyHash{}, "", false, false
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	kh, ok = b.c.BackendForHost(strings.ToLower(strings.TrimSuffix(host, ".")))
+	if !ok {
+		return keyHash{}, "", false, false
+	}
+	return kh, strings.TrimPrefix(r.URL.Path, "/"), true, true
+}
+
+// newRequestID returns a random request ID for Config.RequestID.
+func newRequestID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err) // can't happen
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// statusWriter is an http.ResponseWriter that records the response status and
+// the number of body bytes written, for the access log and the Collector.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach Flush and Hijack.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// flushWriter is an http.ResponseWriter that flushes after every write, for
+// Config.FlushImmediately.
+type flushWriter struct {
+	http.ResponseWriter
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if err == nil {
+		// Errors are reported by the next Write.
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach Flush and Hijack.
+func (w *flushWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingReader is an io.ReadCloser that counts the bytes read from a request
+// body. The body may be read by the HTTP/2 transport after the response is
+// complete, so the count is atomic.
+type countingReader struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// Shutdown gracefully shuts down the Bastion. New backend connections are
+// rejected, new requests are served a 503 Service Unavailable status, and all
+// backend connections are closed once their in-flight requests complete.
+//
+// Shutdown returns when all backend connections are closed, or when ctx
+// expires, in which case it closes the remaining connections, failing their
+// in-flight requests, and returns the context's error.
+//
+// Shutdown can be called multiple times and concurrently with ServeHTTP.
+func (b *Bastion) Shutdown(ctx context.Context) error {
+	return b.pool.shutdown(ctx)
+}
+
+// SetAllowedBackends replaces the set of backends allowed to connect, by the
+// hash of their Ed25519 public key. It's only used if neither
+// [Config.AllowedBackend] nor [Config.AdmitBackend] is set, in which case no
+// backends are allowed until SetAllowedBackends is called.
+//
+// Connected backends that are not in the new set are disconnected, as by
+// [Bastion.RecheckAllowedBackends]. SetAllowedBackends makes a copy of
+// backends, and it may be called concurrently with connections being
+// established.
+func (b *Bastion) SetAllowedBackends(backends map[[sha256.Size]byte]bool) {
+	allowed := make(map[keyHash]bool, len(backends))
+	for kh, ok := range backends {
+		if ok {
+			allowed[kh] = true
+		}
+	}
+	b.allowed.Store(&allowed)
+	b.RecheckAllowedBackends()
+}
+
+// RecheckAllowedBackends checks all connected backends against
+// [Config.AdmitBackend], [Config.AllowedBackend], or the set passed to
+// [Bastion.SetAllowedBackends], and immediately disconnects the ones that are
+// no longer allowed. Otherwise, revocations only take effect when a backend
+// reconnects.
+//
+// It should be called whenever the data backing AllowedBackend changes. It's
+// also called every [Config.ReapInterval].
+func (b *Bastion) RecheckAllowedBackends() {
+	b.pool.disconnectDisallowed()
+}
+
+// Pause makes ServeHTTP reject all requests with a 503 Service Unavailable
+// status, until Resume is called. Backend connections are not affected, and
+// new ones are still accepted, but [Bastion.Ready] reports false.
+func (b *Bastion) Pause() {
+	b.paused.Store(true)
+}
+
+// Resume undoes a previous call to Pause.
+func (b *Bastion) Resume() {
+	b.paused.Store(false)
+}
+
+// Paused returns whether the Bastion is paused. See [Bastion.Pause].
+func (b *Bastion) Paused() bool {
+	return b.paused.Load()
+}
+
+// SetDraining puts the Bastion in or out of draining mode. While draining,
+// connections from backends that are not already connected are rejected, and
+// so are requests for them, but connected backends keep being served (and can
+// replace their connections) until Shutdown is called.
+func (b *Bastion) SetDraining(draining bool) {
+	b.pool.draining.Store(draining)
+}
+
+// Ready returns whether the Bastion is not paused and at least
+// [Config.MinBackendsForReady] backends are connected. It can be used to
+// implement a readiness check.
+func (b *Bastion) Ready() bool {
+	return !b.paused.Load() && b.pool.connectedBackends() >= b.c.MinBackendsForReady
+}
+
+// ReadyHandler returns a handler for readiness checks, which responds with a
+// 200 OK status if [Bastion.Ready] returns true, and with a 503 Service
+// Unavailable status otherwise, so that load balancers don't route clients to
+// the bastion before enough backends are connected, or while it's paused.
+//
+// Like [Bastion.InfoHandler], the handler doesn't do any authentication.
+func (b *Bastion) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if b.paused.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready: bastion is paused\n")
+			return
+		}
+		n := b.pool.connectedBackends()
+		if n < b.c.MinBackendsForReady {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready: %d of %d backends connected\n", n, b.c.MinBackendsForReady)
+			return
+		}
+		fmt.Fprintf(w, "ready: %d backends connected\n", n)
+	})
+}
+
+// ConnectedBackends returns the key hashes of the backends that currently have
+// a live connection to the bastion, sorted.
+func (b *Bastion) ConnectedBackends() [][sha256.Size]byte {
+	b.pool.RLock()
+	defer b.pool.RUnlock()
+	var backends [][sha256.Size]byte
+	for kh, bc := range b.pool.conns {
+		if !bc.cc.State().Closed {
+			backends = append(backends, kh)
+		}
+	}
+	slices.SortFunc(backends, func(a, b [sha256.Size]byte) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	return backends
+}
+
+// ConnectionTLS returns the TLS parameters negotiated by the current
+// connection of the backend with the given key hash, and whether the backend
+// is connected.
+func (b *Bastion) ConnectionTLS(keyHash [sha256.Size]byte) (BackendTLS, bool) {
+	b.pool.RLock()
+	defer b.pool.RUnlock()
+	bc, ok := b.pool.conns[keyHash]
+	if !ok || bc.cc.State().Closed {
+		return BackendTLS{}, false
+	}
+	return bc.tls, true
+}
+
+// IsConnected reports whether the backend with the given key hash is
+// connected.
+func (b *Bastion) IsConnected(keyHash [sha256.Size]byte) bool {
+	_, ok := b.ConnectedSince(keyHash)
+	return ok
+}
+
+// ConnectedSince returns when the current connection of the backend with the
+// given key hash was accepted, and whether the backend is connected.
+func (b *Bastion) ConnectedSince(keyHash [sha256.Size]byte) (time.Time, bool) {
+	b.pool.RLock()
+	defer b.pool.RUnlock()
+	bc, ok := b.pool.conns[keyHash]
+	if !ok || bc.cc.State().Closed {
+		return time.Time{}, false
+	}
+	return bc.since, true
+}
+
+// InFlight returns the number of requests currently being forwarded to all
+// backends. A request is in flight until its response body is fully copied to
+// the client, or the client goes away.
+func (b *Bastion) InFlight() int {
+	return int(b.pool.inflight.Load())
+}
+
+// BackendInFlight returns the number of requests currently being forwarded to
+// the backend with the given key hash, or zero if it's not connected.
+func (b *Bastion) BackendInFlight(keyHash [sha256.Size]byte) int {
+	b.pool.RLock()
+	defer b.pool.RUnlock()
+	bc, ok := b.pool.conns[keyHash]
+	if !ok {
+		return 0
+	}
+	return int(bc.inflight.Load())
+}
+
+// ForceDisconnect closes the connection of the backend with the given key
+// hash, if any, and reports whether one was found. Requests in flight to the
+// backend fail, and further requests are rejected as for any unavailable
+// backend, until it reconnects.
+func (b *Bastion) ForceDisconnect(keyHash [sha256.Size]byte) bool {
+	conns := b.pool.take(keyHash)
+	if len(conns) == 0 {
+		return false
+	}
+	b.pool.logEvent(keyHash, "disconnected", nil, "forcibly disconnecting backend")
+	for _, bc := range conns {
+		bc.cc.Close()
+	}
+	return true
+}
+
+// DisconnectAll immediately closes all backend connections, failing any
+// requests in flight. Unlike Shutdown, it doesn't wait for requests to
+// complete, and it doesn't prevent backends from connecting again.
+func (b *Bastion) DisconnectAll() {
+	b.pool.Lock()
+	conns, replicas := b.pool.conns, b.pool.replicas
+	b.pool.conns = make(map[keyHash]*backendConn)
+	b.pool.replicas = make(map[keyHash][]*backendConn)
+	b.pool.Unlock()
+	b.pool.logf("disconnected", nil, "forcibly disconnecting all %d backends", len(conns))
+	for _, bc := range conns {
+		bc.cc.Close()
+	}
+	for _, rr := range replicas {
+		for _, bc := range rr {
+			bc.cc.Close()
+		}
+	}
+}
+
+// AcceptedConnections returns the total number of backend connections
+// accepted since the Bastion was created.
+func (b *Bastion) AcceptedConnections() int {
+	b.pool.RLock()
+	defer b.pool.RUnlock()
+	return b.pool.accepted
+}
+
+// LifetimeConnectionsReached returns a channel that is closed once the bastion
+// has accepted [Config.MaxLifetimeConnections] backend connections. If that
+// limit is zero, the channel is never closed.
+func (b *Bastion) LifetimeConnectionsReached() <-chan struct{} {
+	return b.pool.exhausted
+}
+
+// InfoHandler returns a handler that reports, as JSON, the version of the
+// bastion, when it was started, and a summary of its configuration.
+//
+// The configuration values are the effective ones, with defaults applied.
+// Limits and timeouts that are disabled are reported as zero.
+//
+// The handler doesn't do any authentication, and is meant to be mounted on an
+// internal or administrative endpoint.
+func (b *Bastion) InfoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type config struct {
+			Protocols                       []string `json:"protocols"`
+			ForwardHeadersAllowlist         []string `json:"forward_headers_allowlist,omitempty"`
+			BareKeyHashAsRoot               bool     `json:"bare_key_hash_as_root"`
+			FaultInjection                  bool     `json:"fault_injection"`
+			MinBackendsForReady             int      `json:"min_backends_for_ready"`
+			MaxLifetimeConnections          int      `json:"max_lifetime_connections"`
+			MaxBackends                     int      `json:"max_backends"`
+			MaxConnectionsPerBackend        int      `json:"max_connections_per_backend"`
+			RejectExcessConnections         bool     `json:"reject_excess_connections"`
+			MaxConcurrentRequestsPerBackend int      `json:"max_concurrent_requests_per_backend"`
+			RequestsPerSecondPerBackend     float64  `json:"requests_per_second_per_backend"`
+			RequestBurstPerBackend          int      `json:"request_burst_per_backend"`
+			MaxRequestBodyBytes             int64    `json:"max_request_body_bytes"`
+			RequestTimeout                  string   `json:"request_timeout"`
+			AcceptTimeout                   string   `json:"accept_timeout"`
+			PingInterval                    string   `json:"ping_interval"`
+			PingTimeout                     string   `json:"ping_timeout"`
+			ReapInterval                    string   `json:"reap_interval"`
+			IdleTimeout                     string   `json:"idle_timeout"`
+			UnusedConnectionTimeout         string   `json:"unused_connection_timeout"`
+			MaxConnectionAge                string   `json:"max_connection_age"`
+			ReplacedConnectionDrainTimeout  string   `json:"replaced_connection_drain_timeout"`
+		}
+		info := struct {
+			Version   string    `json:"version"`
+			GoVersion string    `json:"go_version"`
+			Started   time.Time `json:"started"`
+			Paused    bool      `json:"paused"`
+			Config    config    `json:"config"`
+		}{
+			Version:   moduleVersion(),
+			GoVersion: runtime.Version(),
+			Started:   b.started,
+			Paused:    b.Paused(),
+		}
+		c, p := b.c, b.pool
+		idleTimeout := c.IdleTimeout
+		if c.ReapInterval == 0 {
+			// IdleTimeout is only enforced by the reaper.
+			idleTimeout = 0
+		}
+		rate, burst := requestRate(c.RequestsPerSecondPerBackend, c.RequestBurstPerBackend)
+		info.Config = config{
+			Protocols:                       b.protocols(),
+			ForwardHeadersAllowlist:         c.ForwardHeadersAllowlist,
+			BareKeyHashAsRoot:               c.BareKeyHashAsRoot,
+			FaultInjection:                  c.FaultInjector != nil,
+			MinBackendsForReady:             c.MinBackendsForReady,
+			MaxLifetimeConnections:          max(c.MaxLifetimeConnections, 0),
+			MaxBackends:                     max(c.MaxBackends, 0),
+			MaxConnectionsPerBackend:        max(c.MaxConnectionsPerBackend, 1),
+			RejectExcessConnections:         c.RejectExcessConnections,
+			MaxConcurrentRequestsPerBackend: max(c.MaxConcurrentRequestsPerBackend, 0),
+			RequestsPerSecondPerBackend:     rate,
+			RequestBurstPerBackend:          burst,
+			MaxRequestBodyBytes:             max(c.MaxRequestBodyBytes, 0),
+			RequestTimeout:                  c.RequestTimeout.String(),
+			AcceptTimeout:                   p.acceptTimeout().String(),
+			PingInterval:                    p.pingInterval().String(),
+			PingTimeout:                     p.pingTimeout().String(),
+			ReapInterval:                    c.ReapInterval.String(),
+			IdleTimeout:                     idleTimeout.String(),
+			UnusedConnectionTimeout:         c.UnusedConnectionTimeout.String(),
+			MaxConnectionAge:                c.MaxConnectionAge.String(),
+			ReplacedConnectionDrainTimeout:  p.drainTimeout().String(),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		e.Encode(info)
+	})
+}
+
+// StatusHandler returns a handler that reports the state of the backend
+// connections, as JSON or, if the "format" query parameter is "text", as one
+// line of text per backend.
+//
+// For each backend, it reports its current connection's age, TLS parameters,
+// the round-trip time of the last PING, which is sent every
+// [Config.PingInterval] (ping_rtt), and of the PING sent when the connection
+// was accepted (handshake_ping_rtt), and its active HTTP/2 streams, as well as
+// the backend's number of requests in flight and of live connections (see
+// [Config.MaxConnectionsPerBackend]).
+//
+// Like [Bastion.InfoHandler], the handler doesn't do any authentication.
+func (b *Bastion) StatusHandler() http.Handler {
+	type backendStatus struct {
+		KeyHash          string    `json:"key_hash"`
+		Name             string    `json:"name,omitempty"`
+		ConnectedSince   time.Time `json:"connected_since"`
+		ConnectedFor     string    `json:"connected_for"`
+		Protocol         string    `json:"protocol"`
+		TLSVersion       string    `json:"tls_version"`
+		CipherSuite      string    `json:"cipher_suite"`
+		Closed           bool      `json:"closed"`
+		Requests         int64     `json:"requests"`
+		InFlight         int64     `json:"in_flight"`
+		Streams          int       `json:"streams"`
+		PingRTT          string    `json:"ping_rtt"`
+		HandshakePingRTT string    `json:"handshake_ping_rtt"`
+		Connections      int       `json:"connections"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		b.pool.RLock()
+		backends := make([]backendStatus, 0, len(b.pool.conns))
+		for kh, bc := range b.pool.conns {
+			st := bc.cc.State()
+			backends = append(backends, backendStatus{
+				KeyHash:          hex.EncodeToString(kh[:]),
+				Name:             bc.policy.Name,
+				ConnectedSince:   bc.since,
+				ConnectedFor:     now.Sub(bc.since).Round(time.Second).String(),
+				Protocol:         bc.tls.NegotiatedProtocol,
+				TLSVersion:       tls.VersionName(bc.tls.Version),
+				CipherSuite:      tls.CipherSuiteName(bc.tls.CipherSuite),
+				Closed:           st.Closed,
+				Requests:         bc.requests.Load(),
+				InFlight:         bc.inflight.Load(),
+				Streams:          st.StreamsActive,
+				PingRTT:          time.Duration(bc.pingRTT.Load()).String(),
+				HandshakePingRTT: bc.rtt.String(),
+				Connections:      1 + len(b.pool.replicas[kh]),
+			})
+		}
+		b.pool.RUnlock()
+		slices.SortFunc(backends, func(a, b backendStatus) int {
+			return strings.Compare(a.KeyHash, b.KeyHash)
+		})
+
+		if r.URL.Query().Get("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintf(w, "%d backends connected\n", len(backends))
+			for _, s := range backends {
+				fmt.Fprintf(w, "%s connected for %s, %d requests, %d in flight, ping RTT %s",
+					s.KeyHash, s.ConnectedFor, s.Requests, s.InFlight, s.PingRTT)
+				if s.Connections > 1 {
+					fmt.Fprintf(w, ", %d connections", s.Connections)
+				}
+				if s.Closed {
+					fmt.Fprintf(w, ", closed")
+				}
+				if s.Name != "" {
+					fmt.Fprintf(w, " (%s)", s.Name)
+				}
+				fmt.Fprintf(w, "\n")
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Backends []backendStatus `json:"backends"`
+		}{backends})
+	})
+}
+
+// moduleVersion returns the version of the filippo.io/litetlog module linked
+// in the binary, according to its build info.
+func moduleVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if bi.Main.Path == "filippo.io/litetlog" {
+		return bi.Main.Version
+	}
+	for _, m := range bi.Deps {
+		if m.Path == "filippo.io/litetlog" {
+			if m.Replace != nil {
+				return m.Replace.Version
+			}
+			return m.Version
+		}
+	}
+	return "unknown"
+}
+
+func (b *Bastion) notFound(w http.ResponseWriter, r *http.Request, detail string) {
+	if b.c.NotFoundHandler != nil {
+		b.serveSynthesized(b.c.NotFoundHandler, w, r, "not_found")
+		return
+	}
+	b.writeError(w, r, http.StatusNotFound, "not_found", detail)
+}
+
+// serveSynthesized serves r with a handler configured to respond in place of
+// a backend, and counts the response with the given reason.
+func (b *Bastion) serveSynthesized(h http.Handler, w http.ResponseWriter, r *http.Request, reason string) {
+	sw := &statusWriter{ResponseWriter: w}
+	h.ServeHTTP(sw, r)
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	b.pool.synthesized(r.Context(), sw.status, reason)
+}
+
+// clientIP returns the IP address of the client that sent r, or nil if it
+// can't be determined. If the client address headers are trusted, it's the
+// address added by the last proxy, rather than the address of the proxy.
+func (b *Bastion) clientIP(r *http.Request) net.IP {
+	if b.trustForwarded(r) {
+		var last string
+		if b.c.ForwardedFormat == ForwardedFormatRFC7239 {
+			last = lastForwardedFor(r.Header.Values("Forwarded"))
+		} else if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			elems := strings.Split(xff[len(xff)-1], ",")
+			last = strings.TrimSpace(elems[len(elems)-1])
+		}
+		if ip := parseIP(last); ip != nil {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// lastForwardedFor returns the for parameter of the last element of the RFC
+// 7239 Forwarded header values, unquoted, or "" if there is none.
+func lastForwardedFor(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	elems := strings.Split(values[len(values)-1], ",")
+	for _, pair := range strings.Split(elems[len(elems)-1], ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if strings.EqualFold(name, "for") {
+			if v, err := strconv.Unquote(value); err == nil {
+				return v
+			}
+			return value
+		}
+	}
+	return ""
+}
+
+// parseIP parses an IP address optionally followed by a port, with IPv6
+// addresses in brackets if there is a port, or returns nil.
+func parseIP(s string) net.IP {
+	if addr, err := netip.ParseAddrPort(s); err == nil {
+		return net.IP(addr.Addr().Unmap().AsSlice())
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return net.IP(addr.Unmap().AsSlice())
+	}
+	return nil
+}
+
+type backendContextKey struct{}
+type startContextKey struct{}
+type requestIDContextKey struct{}
+type protocolContextKey struct{}
+
+// versionProtocol returns the bastion protocol selected by a "v<N>" path
+// segment, or false if s is not a version segment.
+func versionProtocol(s string) (string, bool) {
+	v, ok := strings.CutPrefix(s, "v")
+	if !ok || v == "" || len(v) > 1 && v[0] == '0' {
+		return "", false
+	}
+	for _, c := range []byte(v) {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return "bastion/" + v, true
+}
+
+// parseKeyHash decodes a backend key hash from a request path segment, which
+// may be hex or unpadded base32, in either case.
+func parseKeyHash(s string) (keyHash, bool) {
+	var kh keyHash
+	var n int
+	var err error
+	switch len(s) {
+	case hex.EncodedLen(sha256.Size):
+		n, err = hex.Decode(kh[:], []byte(s))
+	case base32NoPadding.EncodedLen(sha256.Size):
+		n, err = base32NoPadding.Decode(kh[:], []byte(strings.ToUpper(s)))
+	default:
+		return keyHash{}, false
+	}
+	if err != nil || n != sha256.Size {
+		return keyHash{}, false
+	}
+	return kh, true
+}
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// BackendFromContext returns the hash of the Ed25519 public key of the backend
+// that a request is being routed to by [Bastion.ServeHTTP].
+//
+// It can be used with the context of the requests that ServeHTTP forwards,
+// for example in callbacks that are passed the outgoing request. Middleware
+// wrapping ServeHTTP sees the incoming request instead, and should use
+// [Bastion.BackendForRequest].
+func BackendFromContext(ctx context.Context) ([sha256.Size]byte, bool) {
+	kh, ok := ctx.Value(backendContextKey{}).(keyHash)
+	return kh, ok
+}
+
+type backendConnectionsPool struct {
+	// done is closed when the context passed to NewWithContext is canceled.
+	done <-chan struct{}
+
+	c     *Config
+	log   *log.Logger
+	admit func(keyHash [sha256.Size]byte) (BackendPolicy, bool)
+	sync.RWMutex
+	conns map[keyHash]*backendConn
+	// replicas are the older live connections of backends with more than one
+	// connection, oldest first. See Config.MaxConnectionsPerBackend.
+	replicas map[keyHash][]*backendConn
+
+	// shuttingDown is set by Shutdown. It's only set while holding the lock,
+	// so that handleBackend can't register a connection Shutdown won't see.
+	shuttingDown atomic.Bool
+	// stopped is closed by the first call to Shutdown.
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	// draining is set by SetDraining.
+	draining atomic.Bool
+
+	// inflight is the total number of requests in flight to all backends.
+	inflight atomic.Int64
+
+	// accepted is the number of backend connections accepted so far.
+	accepted int
+	// exhausted is closed when accepted reaches MaxLifetimeConnections.
+	exhausted chan struct{}
+
+	metrics metrics
+
+	// flaps tracks recent connections by backend, for MaxReconnects.
+	flaps map[keyHash]*flapState
+
+	// fingerprints is the leaf certificate fingerprint of the last accepted
+	// connection of each backend, to detect certificate changes.
+	fingerprints map[keyHash][sha256.Size]byte
+
+	// buckets are the request rate limiters of each backend. They are
+	// guarded by bucketsMu rather than the pool lock, since they are looked
+	// up on every proxied request.
+	bucketsMu sync.Mutex
+	buckets   map[keyHash]*tokenBucket
+}
+
+type flapState struct {
+	connects      []time.Time
+	cooldownUntil time.Time
+}
+
+// allowConnect records a new connection from backend, and returns false if
+// the backend is reconnecting too often, along with when it will be allowed
+// to connect again.
+func (p *backendConnectionsPool) allowConnect(backend keyHash, now time.Time) (bool, time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	limit, window, cooldown := p.c.MaxReconnects, p.c.ReconnectWindow, p.c.ReconnectCooldown
+	if limit < 0 {
+		return true, time.Time{}
+	}
+	if limit == 0 {
+		limit = 10
+	}
+	if window == 0 {
+		window = 1 * time.Minute
+	}
+	if cooldown == 0 {
+		cooldown = window
+	}
+	f, ok := p.flaps[backend]
+	if !ok {
+		f = &flapState{}
+		p.flaps[backend] = f
+	}
+	if now.Before(f.cooldownUntil) {
+		return false, f.cooldownUntil
+	}
+	f.connects = slices.DeleteFunc(f.connects, func(t time.Time) bool {
+		return now.Sub(t) >= window
+	})
+	if len(f.connects) >= limit {
+		f.connects = nil
+		f.cooldownUntil = now.Add(cooldown)
+		return false, f.cooldownUntil
+	}
+	f.connects = append(f.connects, now)
+	return true, time.Time{}
+}
+
+type backendConn struct {
+	cc clientConn
+
+	// inflight is the number of requests in flight to the backend. It's shared
+	// with the connection this one replaced, if any, so that it's tracked per
+	// backend rather than per connection.
+	inflight *atomic.Int64
+
+	// used is set once a request is routed to the connection.
+	used atomic.Bool
+	// lastUsed is the time, in Unix nanoseconds, the connection was last
+	// routed a request, or when it was accepted.
+	lastUsed atomic.Int64
+	// requests is the number of requests routed to the connection.
+	requests atomic.Int64
+	// since is when the connection was accepted.
+	since time.Time
+	// rtt is the round-trip time of the PING sent when the connection was
+	// accepted.
+	rtt time.Duration
+	// pingRTT is the round-trip time, in nanoseconds, of the last PING sent
+	// by pinger, or rtt until the first one.
+	pingRTT atomic.Int64
+	// fingerprint is the SHA-256 hash of the backend's leaf certificate.
+	fingerprint [sha256.Size]byte
+	// tls are the TLS parameters negotiated by the backend, including the
+	// bastion ALPN protocol.
+	tls BackendTLS
+
+	policy BackendPolicy
+}
+
+func (p *backendConnectionsPool) RoundTrip(r *http.Request) (*http.Response, error) {
+	kh, ok := BackendFromContext(r.Context())
+	if !ok {
+		return p.syntheticResponse(r, http.StatusNotFound, "not_found", "invalid backend key hash"), nil
+	}
+	if p.c.FaultInjector != nil {
+		if delay, status, inject := p.c.FaultInjector(kh, r); inject {
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				t.Stop()
+				return nil, r.Context().Err()
+			}
+			if status != 0 {
+				return p.syntheticResponse(r, status, "injected_fault", "injected fault"), nil
+			}
+		}
+	}
+	if p.shuttingDown.Load() {
+		return p.syntheticResponse(r, http.StatusServiceUnavailable, "shutting_down", "bastion is shutting down"), nil
+	}
+	protocol, _ := r.Context().Value(protocolContextKey{}).(string)
+	bc, ok := p.pick(kh, nil, protocol)
+	if ok && bc.cc.State().Closed {
+		// The connection died (for example because the backend half-closed
+		// it) but handleBackend didn't notice yet. Don't wait for it.
+		p.remove(kh, bc)
+		ok = false
+	}
+	if !ok && p.draining.Load() {
+		return p.syntheticResponse(r, http.StatusServiceUnavailable, "draining", "bastion is draining"), nil
+	}
+	if !ok {
+		if _, allowed := p.admit(kh); !allowed {
+			// Distinguish misrouted requests from backends that are
+			// temporarily offline, which are worth retrying.
+			return p.syntheticResponse(r, http.StatusNotFound, "unknown_backend", "unknown backend"), nil
+		}
+		resp := p.syntheticResponse(r, http.StatusServiceUnavailable, "unavailable", "backend unavailable")
+		resp.Header.Set("Retry-After", p.retryAfter(kh, time.Now()))
+		return resp, nil
+	}
+	if resp := p.begin(r, kh, bc); resp != nil {
+		return resp, nil
+	}
+	// inflight is the counter acquired by begin, which must be released
+	// exactly once, even if the request is retried on another connection.
+	inflight := bc.inflight
+	var timing RequestTiming
+	start, _ := r.Context().Value(startContextKey{}).(time.Time)
+	timing.Resolve = time.Since(start)
+	in := r
+	emulateHEAD := r.Method == http.MethodHead && p.c.EmulateHEAD != nil && p.c.EmulateHEAD(kh)
+	if emulateHEAD {
+		r = r.Clone(r.Context())
+		r.Method = http.MethodGet
+	}
+	resp, err := bc.cc.RoundTrip(r)
+	if err != nil && canRetry(r, err) {
+		// The backend might have reconnected between the lookup and the
+		// RoundTrip, and the old connection refused the request because it's
+		// shutting down. If so, retry once on the new connection. The retry
+		// goes through the backend's limits again, since the new connection
+		// might have a different policy and in-flight counter.
+		next, ok := p.pick(kh, bc, protocol)
+		if ok && !next.cc.State().Closed {
+			if bc.cc.State().Closed {
+				p.remove(kh, bc)
+			}
+			p.release(inflight)
+			if resp := p.begin(r, kh, next); resp != nil {
+				return resp, nil
+			}
+			bc, inflight = next, next.inflight
+			resp, err = bc.cc.RoundTrip(r)
+		}
+	}
+	if err == nil {
+		p.metrics.countBackendResponse(resp.StatusCode)
+	}
+	if err != nil && bc.cc.State().Closed {
+		p.remove(kh, bc)
+	}
+	timing.FirstByte = time.Since(start)
+	if err != nil {
+		p.release(inflight)
+		return nil, err
+	}
+	if emulateHEAD {
+		// Closing the body resets the stream, so the backend can stop sending
+		// it. The headers, including Content-Length, are the ones of the GET.
+		p.release(inflight)
+		resp.Body.Close()
+		resp.Body = http.NoBody
+		resp.Request = in
+		if p.c.ObserveRequestTiming != nil {
+			timing.Total = timing.FirstByte
+			p.c.ObserveRequestTiming(kh, in, timing)
+		}
+		return resp, nil
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The ReverseProxy needs the body to be an io.ReadWriteCloser, so
+		// don't wrap it. Upgraded connections are not counted as in flight.
+		p.release(inflight)
+		return resp, nil
+	}
+	// If the backend resets the stream after sending the headers, the
+	// ReverseProxy aborts the client response, but it doesn't know which
+	// backend was at fault.
+	resp.Body = &backendBody{ReadCloser: resp.Body, p: p, r: r, backend: kh,
+		inflight: inflight, start: start, timing: timing}
+	return resp, nil
+}
+
+// begin checks the rate and concurrency limits of backend before r is sent on
+// bc, and if they allow it, counts r as routed to bc and in flight. Otherwise,
+// it returns the response to send instead.
+func (p *backendConnectionsPool) begin(r *http.Request, backend keyHash, bc *backendConn) *http.Response {
+	if ok, retryAfter := p.allowRequest(backend, bc.policy, time.Now()); !ok {
+		resp := p.syntheticResponse(r, http.StatusTooManyRequests, "rate_limited", "request rate limit exceeded for backend")
+		resp.Header.Set("Retry-After", retryAfter)
+		return resp
+	}
+	bc.used.Store(true)
+	bc.lastUsed.Store(time.Now().UnixNano())
+	bc.requests.Add(1)
+	inflight := p.acquire(bc.inflight)
+	limit := p.c.MaxConcurrentRequestsPerBackend
+	if bc.policy.MaxConcurrentRequests != 0 {
+		limit = bc.policy.MaxConcurrentRequests
+	}
+	if limit > 0 && inflight > int64(limit) {
+		p.release(bc.inflight)
+		return p.syntheticResponse(r, http.StatusTooManyRequests, "concurrency_limited", "too many concurrent requests for backend")
+	}
+	return nil
+}
+
+// canRetry returns whether err, returned by ClientConn.RoundTrip, guarantees
+// the backend didn't process r, and r has no body that might have been
+// consumed, so that it can be safely sent again on a different connection.
+func canRetry(r *http.Request, err error) bool {
+	if r.Body != nil && r.Body != http.NoBody {
+		return false
+	}
+	if se := (http2.StreamError{}); errors.As(err, &se) {
+		return se.Code == http2.ErrCodeRefusedStream
+	}
+	// These errors are not exported by golang.org/x/net/http2.
+	switch err.Error() {
+	case "http2: client conn not usable",
+		"http2: Transport received Server's graceful shutdown GOAWAY":
+		return true
+	}
+	return false
+}
+
+// notifyConn is a net.Conn that closes the closed channel when Close is called.
+type notifyConn struct {
+	*tls.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *notifyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	// http2.ClientConn force-closes a *tls.Conn whose close_notify write hangs
+	// on an unresponsive peer, but it can't see through this wrapper, so do
+	// the same here.
+	t := time.AfterFunc(250*time.Millisecond, func() { c.Conn.NetConn().Close() })
+	defer t.Stop()
+	return c.Conn.Close()
+}
+
+type backendBody struct {
+	io.ReadCloser
+	p       *backendConnectionsPool
+	r       *http.Request
+	backend keyHash
+
+	inflight *atomic.Int64
+	start    time.Time
+	timing   RequestTiming
+	closed   bool
+}
+
+func (b *backendBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.closed {
+		return err
+	}
+	b.closed = true
+	b.p.release(b.inflight)
+	if b.p.c.ObserveRequestTiming != nil {
+		b.timing.Total = time.Since(b.start)
+		b.p.c.ObserveRequestTiming(b.backend, b.r, b.timing)
+	}
+	return err
+}
+
+func (b *backendBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.r.Context().Err() == nil {
+		if id, ok := b.r.Context().Value(requestIDContextKey{}).(string); ok {
+			b.p.logEventAttrs(b.backend, "response_interrupted", err,
+				[]slog.Attr{slog.String("request_id", id)}, "response body interrupted (request %s)", id)
+		} else {
+			b.p.logEvent(b.backend, "response_interrupted", err, "response body interrupted")
+		}
+	}
+	return n, err
+}
+
+// acquire counts a new request in flight, both in the backend counter and in
+// the pool total, and returns the new backend count.
+func (p *backendConnectionsPool) acquire(inflight *atomic.Int64) int64 {
+	p.inflight.Add(1)
+	return inflight.Add(1)
+}
+
+// release undoes acquire, once the request is complete.
+func (p *backendConnectionsPool) release(inflight *atomic.Int64) {
+	inflight.Add(-1)
+	p.inflight.Add(-1)
+}
+
+// retryAfterUnavailable is the default Retry-After value, in seconds, sent
+// with responses for backends that are not connected.
+const retryAfterUnavailable = "10"
+
+// retryAfter returns the Retry-After value for a backend that is not
+// connected. If the backend is being rejected for reconnecting too often, it's
+// the time until the cooldown expires, otherwise retryAfterUnavailable.
+func (p *backendConnectionsPool) retryAfter(backend keyHash, now time.Time) string {
+	p.RLock()
+	defer p.RUnlock()
+	f, ok := p.flaps[backend]
+	if !ok || !now.Before(f.cooldownUntil) {
+		return retryAfterUnavailable
+	}
+	wait := f.cooldownUntil.Sub(now) + time.Second - 1
+	return strconv.Itoa(int(wait / time.Second))
+}
+
+// syntheticResponse returns an error response generated by the bastion rather
+// than by a backend, and counts it with the given reason.
+func (p *backendConnectionsPool) syntheticResponse(r *http.Request, status int, reason, detail string) *http.Response {
+	p.synthesized(r.Context(), status, reason)
+	contentType, body := p.c.ErrorFormat.errorBody(status, detail)
+	h := make(http.Header)
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
+
+// connected returns the number of live backend connections.
+// live returns the connections of backend that are not closed, oldest first,
+// in a new slice. p must be locked.
+func (p *backendConnectionsPool) live(backend keyHash) []*backendConn {
+	var conns []*backendConn
+	for _, bc := range p.replicas[backend] {
+		if !bc.cc.State().Closed {
+			conns = append(conns, bc)
+		}
+	}
+	if bc, ok := p.conns[backend]; ok && !bc.cc.State().Closed {
+		conns = append(conns, bc)
+	}
+	return conns
+}
+
+func (p *backendConnectionsPool) connected() int {
+	p.RLock()
+	defer p.RUnlock()
+	n := 0
+	for _, bc := range p.conns {
+		if !bc.cc.State().Closed {
+			n++
+		}
+	}
+	for _, rr := range p.replicas {
+		for _, bc := range rr {
+			if !bc.cc.State().Closed {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// connectedBackends returns the number of distinct backends with at least one
+// live connection. Unlike connected, it counts a backend with multiple
+// connections once.
+func (p *backendConnectionsPool) connectedBackends() int {
+	p.RLock()
+	defer p.RUnlock()
+	n := 0
+	for backend, bc := range p.conns {
+		live := !bc.cc.State().Closed
+		for _, r := range p.replicas[backend] {
+			live = live || !r.cc.State().Closed
+		}
+		if live {
+			n++
+		}
+	}
+	return n
+}
+
+// shutdown stops the pool from accepting new connections and requests, and
+// gracefully shuts down all current connections.
+func (p *backendConnectionsPool) shutdown(ctx context.Context) error {
+	p.Lock()
+	p.shuttingDown.Store(true)
+	p.stopOnce.Do(func() { close(p.stopped) })
+	conns := make([]*backendConn, 0, len(p.conns))
+	for _, bc := range p.conns {
+		conns = append(conns, bc)
+	}
+	for _, rr := range p.replicas {
+		conns = append(conns, rr...)
+	}
+	p.Unlock()
+
+	errs := make(chan error, len(conns))
+	for _, bc := range conns {
+		go func() {
+			err := bc.cc.Shutdown(ctx)
+			if err != nil {
+				// The backend doesn't close the connection on its own after
+				// our GOAWAY, so it would otherwise stay open forever.
+				bc.cc.Close()
+			}
+			errs <- err
+		}()
+	}
+	var err error
+	for range conns {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// reaper runs every ReapInterval until the pool is shut down, dropping closed
+// connections and shutting down idle ones.
+func (p *backendConnectionsPool) reaper() {
+	t := time.NewTicker(p.c.ReapInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-p.done:
+			return
+		}
+		if p.shuttingDown.Load() {
+			return
+		}
+		p.reap(time.Now())
+		p.disconnectDisallowed()
+	}
+}
+
+// disconnectDisallowed closes the connections of backends that are no longer
+// allowed by p.admit.
+func (p *backendConnectionsPool) disconnectDisallowed() {
+	p.RLock()
+	backends := make([]keyHash, 0, len(p.conns))
+	for backend := range p.conns {
+		backends = append(backends, backend)
+	}
+	p.RUnlock()
+
+	for _, backend := range backends {
+		if _, ok := p.admit(backend); ok {
+			continue
+		}
+		if conns := p.take(backend); len(conns) > 0 {
+			p.logEvent(backend, "revoked", nil, "disconnecting backend that is no longer allowed")
+			for _, bc := range conns {
+				bc.cc.Close()
+			}
+		}
+	}
+}
+
+func (p *backendConnectionsPool) reap(now time.Time) {
+	type entry struct {
+		backend keyHash
+		bc      *backendConn
+	}
+	p.RLock()
+	conns := make([]entry, 0, len(p.conns))
+	for backend, bc := range p.conns {
+		conns = append(conns, entry{backend, bc})
+	}
+	for backend, rr := range p.replicas {
+		for _, bc := range rr {
+			conns = append(conns, entry{backend, bc})
+		}
+	}
+	p.RUnlock()
+
+	for _, e := range conns {
+		if e.bc.cc.State().Closed {
+			p.remove(e.backend, e.bc)
+			continue
+		}
+		idle := now.Sub(time.Unix(0, e.bc.lastUsed.Load()))
+		if p.c.IdleTimeout == 0 || idle < p.c.IdleTimeout || e.bc.inflight.Load() > 0 {
+			continue
+		}
+		p.remove(e.backend, e.bc)
+		p.logEvent(e.backend, "idle", nil, "shutting down backend connection idle for %v", idle.Round(time.Second))
+		go p.drain(e.backend, e.bc, "idle")
+	}
+}
+
+// empty returns whether there are no live backend connections.
+func (p *backendConnectionsPool) empty() bool {
+	p.RLock()
+	defer p.RUnlock()
+	for _, bc := range p.conns {
+		if !bc.cc.State().Closed {
+			return false
+		}
+	}
+	return true
+}
+
+// remove deletes the connection bc for backend from the pool, if it's still
+// there. If bc was the current connection, the newest replica takes its place.
+func (p *backendConnectionsPool) remove(backend keyHash, bc *backendConn) {
+	p.Lock()
+	defer p.Unlock()
+	rr := p.replicas[backend]
+	if p.conns[backend] == bc {
+		if len(rr) == 0 {
+			delete(p.conns, backend)
+			return
+		}
+		p.conns[backend] = rr[len(rr)-1]
+		rr = rr[:len(rr)-1]
+	} else {
+		rr = slices.DeleteFunc(rr, func(r *backendConn) bool { return r == bc })
+	}
+	if len(rr) == 0 {
+		delete(p.replicas, backend)
+	} else {
+		p.replicas[backend] = rr
+	}
+}
+
+// policy returns the policy of the current connection of backend, if any.
+func (p *backendConnectionsPool) policy(backend keyHash) (BackendPolicy, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	bc, ok := p.conns[backend]
+	if !ok {
+		return BackendPolicy{}, false
+	}
+	return bc.policy, true
+}
+
+// take deletes all the connections for backend from the pool, and returns them.
+func (p *backendConnectionsPool) take(backend keyHash) []*backendConn {
+	p.Lock()
+	defer p.Unlock()
+	bc, ok := p.conns[backend]
+	if !ok {
+		return nil
+	}
+	conns := append(p.replicas[backend], bc)
+	delete(p.conns, backend)
+	delete(p.replicas, backend)
+	return conns
+}
+
+// pick returns the connection for backend with the fewest active streams,
+// other than skip. Closed connections are only returned if there's no other.
+// If protocol is not empty, only connections that negotiated it are returned.
+func (p *backendConnectionsPool) pick(backend keyHash, skip *backendConn, protocol string) (*backendConn, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	var best *backendConn
+	var bestLoad int
+	bestClosed := true
+	consider := func(bc *backendConn) {
+		if bc == skip || protocol != "" && bc.tls.NegotiatedProtocol != protocol {
+			return
+		}
+		st := bc.cc.State()
+		load := st.StreamsActive + st.StreamsReserved + st.StreamsPending
+		switch {
+		case best == nil,
+			bestClosed && !st.Closed,
+			bestClosed == st.Closed && load < bestLoad:
+			best, bestLoad, bestClosed = bc, load, st.Closed
+		}
+	}
+	if bc, ok := p.conns[backend]; ok {
+		consider(bc)
+	}
+	// Replicas are considered newest first, so that ties go to newer ones.
+	rr := p.replicas[backend]
+	for i := len(rr) - 1; i >= 0; i-- {
+		consider(rr[i])
+	}
+	return best, best != nil
+}
+
+// logEvent logs an event about a backend connection, to Config.Logger if set,
+// or to Config.Log otherwise, in which case err is appended to the message.
+func (p *backendConnectionsPool) logEvent(backend keyHash, event string, err error, format string, args ...any) {
+	p.logEventAttrs(backend, event, err, nil, format, args...)
+}
+
+// logEventAttrs is like logEvent, but adds attrs to the structured record.
+func (p *backendConnectionsPool) logEventAttrs(backend keyHash, event string, err error, extra []slog.Attr, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if p.c.Logger == nil {
+		if err != nil {
+			msg += ": " + err.Error()
+		}
+		p.log.Printf("%x: %s", backend, msg)
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("backend", hex.EncodeToString(backend[:])),
+		slog.String("event", event),
+	}
+	attrs = append(attrs, extra...)
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.Any("err", err))
+	}
+	p.c.Logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// logf is like logEvent, but for events that are not about a specific backend.
+func (p *backendConnectionsPool) logf(event string, err error, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if p.c.Logger == nil {
+		if err != nil {
+			msg += ": " + err.Error()
+		}
+		p.log.Print(msg)
+		return
+	}
+	level := slog.LevelInfo
+	attrs := []slog.Attr{slog.String("event", event)}
+	if err != nil {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.Any("err", err))
+	}
+	p.c.Logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// drain shuts down the connection bc, which was replaced by a new connection
+// from the same backend, reached MaxConnectionAge, or exceeded IdleTimeout, as
+// described by kind, and closes it if it doesn't drain within
+// ReplacedConnectionDrainTimeout.
+func (p *backendConnectionsPool) drain(backend keyHash, bc *backendConn, kind string) {
+	timeout := p.drainTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := bc.cc.Shutdown(ctx); err != nil {
+		p.logEvent(backend, "drain_timeout", err,
+			"closing %s connection with requests still in flight after %v", kind, timeout)
+		bc.cc.Close()
+	}
+}
+
+// pinger sends a PING on bc every PingInterval until closed is closed, and
+// records its round-trip time for StatusHandler. A connection that stops
+// responding is closed by the http2.Transport health check, not here.
+func (p *backendConnectionsPool) pinger(bc *backendConn, closed <-chan struct{}) {
+	t := time.NewTicker(p.pingInterval())
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-closed:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), p.pingTimeout())
+		start := time.Now()
+		err := bc.cc.Ping(ctx)
+		cancel()
+		if err == nil {
+			bc.pingRTT.Store(int64(time.Since(start)))
+		}
+	}
+}
+
+// drainTimeout returns the effective Config.ReplacedConnectionDrainTimeout.
+func (p *backendConnectionsPool) drainTimeout() time.Duration {
+	if p.c.ReplacedConnectionDrainTimeout != 0 {
+		return p.c.ReplacedConnectionDrainTimeout
+	}
+	return 60 * time.Second
+}
+
+// acceptTimeout returns the effective Config.AcceptTimeout.
+func (p *backendConnectionsPool) acceptTimeout() time.Duration {
+	switch {
+	case p.c.AcceptTimeout != 0:
+		return p.c.AcceptTimeout
+	case p.c.PingTimeout != 0:
+		return p.c.PingTimeout
+	default:
+		return 5 * time.Second
+	}
+}
+
+// pingInterval and pingTimeout return the effective Config.PingInterval and
+// Config.PingTimeout of established connections.
+func (p *backendConnectionsPool) pingInterval() time.Duration {
+	if p.c.PingInterval != 0 {
+		return p.c.PingInterval
+	}
+	return 15 * time.Second
+}
+
+func (p *backendConnectionsPool) pingTimeout() time.Duration {
+	if p.c.PingTimeout != 0 {
+		return p.c.PingTimeout
+	}
+	return 15 * time.Second
+}
+
+// clientConn is the subset of [http2.ClientConn] used by the pool.
+type clientConn interface {
+	RoundTrip(*http.Request) (*http.Response, error)
+	Ping(context.Context) error
+	State() http2.ClientConnState
+	Shutdown(context.Context) error
+	Close() error
+}
+
+// transport returns the HTTP/2 transport settings of backend connections.
+func (p *backendConnectionsPool) transport() *http2.Transport {
+	return &http2.Transport{
+		ReadIdleTimeout:  p.pingInterval(),
+		PingTimeout:      p.pingTimeout(),
+		MaxReadFrameSize: p.c.MaxReadFrameSize,
+	}
+}
+
+// newClientConn sets up an HTTP/2 client connection over a backend connection.
+func (p *backendConnectionsPool) newClientConn(c net.Conn) (clientConn, error) {
+	return p.transport().NewClientConn(c)
+}
+
+func (p *backendConnectionsPool) handleBackend(hs *http.Server, c *tls.Conn, h http.Handler) {
+	cs := c.ConnectionState()
+	pk, err := backendKey(cs)
+	if err != nil {
+		// VerifyConnection should have rejected this handshake already.
+		p.logf("rejected", err, "rejecting backend connection")
+		p.metrics.rejected.Add(1)
+		return
+	}
+	backend := sha256.Sum256(pk)
+	if ok, until := p.allowConnect(backend, time.Now()); !ok {
+		p.logEvent(backend, "rejected", nil, "rejecting backend connection: reconnecting too often, blocked until %v",
+			until.Format(time.RFC3339))
+		p.metrics.rejected.Add(1)
+		return
+	}
+	acceptTimeout := p.acceptTimeout()
+	// NewClientConn writes the HTTP/2 preface synchronously, so a backend that
+	// doesn't read could block it indefinitely without a deadline.
+	c.SetDeadline(time.Now().Add(acceptTimeout))
+	newClientConn := p.newClientConn
+	if p.c.newClientConn != nil {
+		newClientConn = p.c.newClientConn
+	}
+	nc := &notifyConn{Conn: c, closed: make(chan struct{})}
+	cc, err := newClientConn(nc)
+	if err != nil {
+		p.logEvent(backend, "rejected", err, "failed to convert to HTTP/2 client connection")
+		p.metrics.rejected.Add(1)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), acceptTimeout)
+	defer cancel()
+	pingStart := time.Now()
+	if err := cc.Ping(ctx); err != nil {
+		p.logEvent(backend, "ping_failed", err, "did not respond to PING within %v", acceptTimeout)
+		p.metrics.rejected.Add(1)
+		cc.Close()
+		return
+	}
+	rtt := time.Since(pingStart)
+	c.SetDeadline(time.Time{})
+
+	policy, ok := p.admit(backend)
+	if !ok {
+		p.logEvent(backend, "rejected", nil, "rejecting backend connection: backend is no longer allowed")
+		p.metrics.rejected.Add(1)
+		cc.Close()
+		return
+	}
+	bc := &backendConn{cc: cc, inflight: new(atomic.Int64), policy: policy, since: time.Now(), rtt: rtt,
+		fingerprint: sha256.Sum256(cs.PeerCertificates[0].Raw), tls: BackendTLS{
+			Version:            cs.Version,
+			CipherSuite:        cs.CipherSuite,
+			NegotiatedProtocol: cs.NegotiatedProtocol,
+		}}
+	bc.lastUsed.Store(bc.since.UnixNano())
+	bc.pingRTT.Store(int64(rtt))
+	p.Lock()
+	if p.shuttingDown.Load() {
+		p.Unlock()
+		p.logEvent(backend, "rejected", nil, "rejecting backend connection: bastion is shutting down")
+		p.metrics.rejected.Add(1)
+		cc.Close()
+		return
+	}
+	if old, ok := p.conns[backend]; p.draining.Load() && (!ok || old.cc.State().Closed) {
+		p.Unlock()
+		p.logEvent(backend, "rejected", nil, "rejecting backend connection: bastion is draining")
+		p.metrics.rejected.Add(1)
+		cc.Close()
+		return
+	}
+	if _, ok := p.conns[backend]; !ok && p.c.MaxBackends > 0 && len(p.conns) >= p.c.MaxBackends {
+		p.Unlock()
+		p.logEvent(backend, "rejected", nil, "rejecting backend connection: reached limit of %d backends", p.c.MaxBackends)
+		p.metrics.rejected.Add(1)
+		cc.Close()
+		return
+	}
+	if limit := max(p.c.MaxConnectionsPerBackend, 1); p.c.RejectExcessConnections && len(p.live(backend)) >= limit {
+		p.Unlock()
+		p.logEvent(backend, "rejected", nil, "rejecting backend connection: reached limit of %d connections for backend", limit)
+		p.metrics.rejected.Add(1)
+		cc.Close()
+		return
+	}
+	if limit := p.c.MaxLifetimeConnections; limit > 0 && p.accepted >= limit {
+		p.Unlock()
+		p.logEvent(backend, "rejected", nil, "rejecting backend connection: reached limit of %d lifetime connections", limit)
+		p.metrics.rejected.Add(1)
+		cc.Close()
+		return
+	}
+	p.accepted++
+	if p.accepted == p.c.MaxLifetimeConnections {
+		close(p.exhausted)
+	}
+	// replaced is whether the new connection displaces a live one.
+	var replaced bool
+	if old, ok := p.conns[backend]; ok {
+		bc.inflight = old.inflight
+		rr := p.live(backend)
+		if len(rr) >= max(p.c.MaxConnectionsPerBackend, 1) {
+			replaced = true
+			go p.drain(backend, rr[0], "replaced")
+			rr = rr[1:]
+		}
+		if len(rr) > 0 {
+			p.replicas[backend] = rr
+		} else {
+			delete(p.replicas, backend)
+		}
+	}
+	p.conns[backend] = bc
+	prevFingerprint, seen := p.fingerprints[backend]
+	p.fingerprints[backend] = bc.fingerprint
+	p.Unlock()
+
+	if seen && prevFingerprint != bc.fingerprint {
+		p.logEvent(backend, "certificate_changed", nil, "backend certificate changed from %x to %x",
+			prevFingerprint[:8], bc.fingerprint[:8])
+	}
+
+	if policy.Name != "" {
+		p.logEvent(backend, "connected", nil, "accepted new backend connection (%s)", policy.Name)
+	} else {
+		p.logEvent(backend, "connected", nil, "accepted new backend connection")
+	}
+	if p.c.Collector != nil {
+		p.c.Collector.BackendConnected(backend, replaced)
+	}
+	if p.c.OnBackendConnect != nil {
+		p.c.OnBackendConnect(backend, replaced)
+	}
+	if p.c.MaxConnectionAge != 0 {
+		t := time.AfterFunc(p.c.MaxConnectionAge, func() {
+			p.remove(backend, bc)
+			p.logEvent(backend, "max_age", nil, "shutting down backend connection older than %v",
+				p.c.MaxConnectionAge)
+			p.drain(backend, bc, "expired")
+		})
+		defer t.Stop()
+	}
+	if p.c.UnusedConnectionTimeout != 0 {
+		t := time.AfterFunc(p.c.UnusedConnectionTimeout, func() {
+			if bc.used.Load() {
+				return
+			}
+			p.logEvent(backend, "unused", nil, "closing backend connection that served no requests in %v",
+				p.c.UnusedConnectionTimeout)
+			p.metrics.unusedClosed.Add(1)
+			cc.Close()
+		})
+		defer t.Stop()
+	}
+	go p.pinger(bc, nc.closed)
+	// We need not to return, or http.Server will close this connection. The
+	// ClientConn always closes its net.Conn when it's done, so wait for that.
+	// (Server.ConnState is not an option, because the Server reports
+	// StateClosed only after this function returns.)
+	<-nc.closed
+	p.remove(backend, bc)
+	lifetime := time.Since(bc.since)
+	p.metrics.lifetimes.observe(lifetime)
+	p.logEventAttrs(backend, "expired", nil, []slog.Attr{slog.Duration("duration", lifetime)},
+		"backend connection expired after %v", lifetime.Round(time.Second))
+	if p.c.Collector != nil {
+		p.c.Collector.BackendDisconnected(backend)
+	}
+	if p.c.OnBackendDisconnect != nil {
+		p.c.OnBackendDisconnect(backend, lifetime)
 	}
-	p.log.Printf("%x: backend connection expired", backend)
 }
@@ -0,0 +1,3415 @@
+package bastion
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// testBastion starts a Bastion behind an httptest TLS server. If
+// c.AllowedBackend is nil, all backends are allowed.
+func testBastion(t *testing.T, c *Config) (*Bastion, *httptest.Server) {
+	t.Helper()
+	return testBastionWithContext(t, context.Background(), c)
+}
+
+// testBastionWithContext is like testBastion, but uses NewWithContext.
+func testBastionWithContext(t *testing.T, ctx context.Context, c *Config) (*Bastion, *httptest.Server) {
+	t.Helper()
+	if c.AllowedBackend == nil {
+		c.AllowedBackend = func([sha256.Size]byte) bool { return true }
+	}
+	return testServer(t, ctx, c)
+}
+
+// testServer is like testBastionWithContext, but leaves c.AllowedBackend nil
+// if it's not set.
+func testServer(t *testing.T, ctx context.Context, c *Config) (*Bastion, *httptest.Server) {
+	t.Helper()
+	hs := httptest.NewUnstartedServer(nil)
+	if c.GetCertificate == nil {
+		c.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &hs.TLS.Certificates[0], nil
+		}
+	}
+	if c.Log == nil {
+		c.Log = log.New(&testLog{t: t}, "", 0)
+	}
+	b, err := NewWithContext(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.Config.Handler = b
+	if err := b.ConfigureServer(hs.Config); err != nil {
+		t.Fatal(err)
+	}
+	hs.TLS = hs.Config.TLSConfig
+	hs.StartTLS()
+	t.Cleanup(hs.Close)
+	return b, hs
+}
+
+// testLog is a concurrency-safe log buffer that also logs to t.
+type testLog struct {
+	t  *testing.T
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (l *testLog) Write(p []byte) (int, error) {
+	l.t.Logf("%s", p)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *testLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+// testBackend connects a new backend serving h to the bastion at hs, and waits
+// for the bastion to accept it.
+func testBackend(t *testing.T, b *Bastion, hs *httptest.Server, h http.Handler) (keyHash, *tls.Conn) {
+	t.Helper()
+	kh, conn, _ := dialBackend(t, hs, h)
+	waitFor(t, func() bool {
+		b.pool.RLock()
+		defer b.pool.RUnlock()
+		_, ok := b.pool.conns[kh]
+		return ok
+	})
+	return kh, conn
+}
+
+// dialBackend connects a new backend serving h to the bastion at hs. The
+// returned channel is closed when the backend stops serving the connection.
+func dialBackend(t *testing.T, hs *httptest.Server, h http.Handler) (keyHash, *tls.Conn, <-chan struct{}) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialBackendWithKey(t, hs, priv, h)
+}
+
+// dialBackendWithKey is like dialBackend, but authenticates with priv.
+func dialBackendWithKey(t *testing.T, hs *httptest.Server, priv ed25519.PrivateKey, h http.Handler) (keyHash, *tls.Conn, <-chan struct{}) {
+	t.Helper()
+	pub := priv.Public().(ed25519.PublicKey)
+	return dialBackendWithCert(t, hs, backendCertificate(t, pub, priv), priv, h)
+}
+
+func tlsDialBackend(hs *httptest.Server, cert []byte, priv ed25519.PrivateKey, protos ...string) (*tls.Conn, error) {
+	return tls.Dial("tcp", hs.Listener.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{cert},
+			PrivateKey:  priv,
+		}},
+		MinVersion:         tls.VersionTLS13,
+		NextProtos:         protos,
+		InsecureSkipVerify: true,
+	})
+}
+
+// backendCertificate returns a certificate for pub, signed by signer, which is
+// normally the private key for pub.
+func backendCertificate(t *testing.T, pub ed25519.PublicKey, signer ed25519.PrivateKey) []byte {
+	t.Helper()
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// dialBackendWithCert is like dialBackend, but authenticates with the given
+// certificate and private key.
+func dialBackendWithCert(t *testing.T, hs *httptest.Server, cert []byte, priv ed25519.PrivateKey, h http.Handler) (keyHash, *tls.Conn, <-chan struct{}) {
+	t.Helper()
+	conn, err := tlsDialBackend(hs, cert, priv, "bastion/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: h})
+	}()
+	return keyHash(sha256.Sum256(priv.Public().(ed25519.PublicKey))), conn, done
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+func testGet(t *testing.T, hs *httptest.Server, path string) (*http.Response, string) {
+	t.Helper()
+	resp, err := hs.Client().Get(hs.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+var helloHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "hello from "+r.URL.Path)
+})
+
+func TestProxy(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+
+	resp, body := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/foo")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+	if body != "hello from /foo" {
+		t.Errorf("got body %q", body)
+	}
+}
+
+func TestHalfClosedBackend(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	kh, conn := testBackend(t, b, hs, helloHandler)
+
+	b.pool.RLock()
+	bc := b.pool.conns[kh]
+	b.pool.RUnlock()
+
+	// Close the backend's write side, so the bastion reads EOF while the
+	// backend could still read.
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return bc.cc.State().Closed })
+
+	resp, _ := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/foo")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want 503", resp.StatusCode)
+	}
+	b.pool.RLock()
+	_, ok := b.pool.conns[kh]
+	b.pool.RUnlock()
+	if ok {
+		t.Errorf("closed connection is still in the pool")
+	}
+}
+
+func TestUnusedConnectionTimeout(t *testing.T) {
+	b, hs := testBastion(t, &Config{UnusedConnectionTimeout: 200 * time.Millisecond})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/")
+	unused, _ := testBackend(t, b, hs, helloHandler)
+
+	b.pool.RLock()
+	bc := b.pool.conns[unused]
+	b.pool.RUnlock()
+	waitFor(t, func() bool { return bc.cc.State().Closed })
+
+	if resp, _ := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("used connection: got status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestBackendResetMidResponse(t *testing.T) {
+	l := &testLog{t: t}
+	b, hs := testBastion(t, &Config{Log: log.New(l, "", 0)})
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+
+	resp, err := hs.Client().Get(hs.URL + "/" + hex.EncodeToString(kh[:]) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want 200", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("got complete body %q, expected an error", body)
+	}
+	waitFor(t, func() bool {
+		return strings.Contains(l.String(), hex.EncodeToString(kh[:])+": response body interrupted")
+	})
+}
+
+func TestForwardHeadersAllowlist(t *testing.T) {
+	b, hs := testBastion(t, &Config{ForwardHeadersAllowlist: []string{"x-allowed"}})
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Write(w)
+	}))
+
+	req, err := http.NewRequest("GET", hs.URL+"/"+hex.EncodeToString(kh[:])+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Allowed", "yes")
+	req.Header.Set("X-Stripped", "yes")
+	req.Header.Set("Cookie", "secret")
+	resp, err := hs.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []string{"X-Allowed: yes", "X-Forwarded-For: 127.0.0.1"} {
+		if !strings.Contains(string(body), h) {
+			t.Errorf("backend did not receive %q, got:\n%s", h, body)
+		}
+	}
+	for _, h := range []string{"X-Stripped", "Cookie", "User-Agent: Go-http-client"} {
+		if strings.Contains(string(body), h) {
+			t.Errorf("backend received %q, got:\n%s", h, body)
+		}
+	}
+}
+
+func TestBareKeyHash(t *testing.T) {
+	type test struct {
+		path     string
+		status   int
+		body     string
+		location string
+	}
+	for _, asRoot := range []bool{false, true} {
+		b, hs := testBastion(t, &Config{BareKeyHashAsRoot: asRoot})
+		kh, _ := testBackend(t, b, hs, helloHandler)
+		client := hs.Client()
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		khHex := hex.EncodeToString(kh[:])
+
+		tests := []test{
+			{path: "/", status: http.StatusNotFound},
+			{path: "/foo", status: http.StatusNotFound},
+			{path: "/foo/", status: http.StatusNotFound},
+			{path: "/" + khHex[:10] + "/", status: http.StatusNotFound},
+			{path: "/" + khHex + "/", status: http.StatusOK, body: "hello from /"},
+			{path: "/" + khHex + "/foo/", status: http.StatusOK, body: "hello from /foo/"},
+		}
+		if asRoot {
+			tests = append(tests, test{path: "/" + khHex,
+				status: http.StatusOK, body: "hello from /"})
+		} else {
+			tests = append(tests, test{path: "/" + khHex + "?a=b",
+				status: http.StatusPermanentRedirect, location: "/" + khHex + "/?a=b"})
+		}
+		for _, tt := range tests {
+			resp, err := client.Get(hs.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("asRoot=%v %s: got status %d, want %d", asRoot, tt.path, resp.StatusCode, tt.status)
+			}
+			if tt.body != "" && string(body) != tt.body {
+				t.Errorf("asRoot=%v %s: got body %q, want %q", asRoot, tt.path, body, tt.body)
+			}
+			if loc := resp.Header.Get("Location"); loc != tt.location {
+				t.Errorf("asRoot=%v %s: got Location %q, want %q", asRoot, tt.path, loc, tt.location)
+			}
+		}
+	}
+}
+
+func TestFaultInjector(t *testing.T) {
+	b, hs := testBastion(t, &Config{
+		FaultInjector: func(kh [sha256.Size]byte, r *http.Request) (time.Duration, int, bool) {
+			switch r.URL.Path {
+			case "/fail":
+				return 0, http.StatusServiceUnavailable, true
+			case "/slow":
+				return 100 * time.Millisecond, 0, true
+			}
+			return 0, 0, false
+		},
+	})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	prefix := "/" + hex.EncodeToString(kh[:])
+
+	if resp, body := testGet(t, hs, prefix+"/fail"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/fail: got status %d (%q), want 503", resp.StatusCode, body)
+	}
+	start := time.Now()
+	if resp, body := testGet(t, hs, prefix+"/slow"); body != "hello from /slow" {
+		t.Errorf("/slow: got status %d (%q)", resp.StatusCode, body)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("/slow: took %v, expected a delay", d)
+	}
+	if _, body := testGet(t, hs, prefix+"/ok"); body != "hello from /ok" {
+		t.Errorf("/ok: got body %q", body)
+	}
+}
+
+func TestEmulateHEAD(t *testing.T) {
+	getOnly := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Length", "11")
+		io.WriteString(w, "hello world")
+	})
+	var emulated keyHash
+	b, hs := testBastion(t, &Config{
+		EmulateHEAD: func(kh [sha256.Size]byte) bool { return kh == emulated },
+	})
+	emulated, _ = testBackend(t, b, hs, getOnly)
+	other, _ := testBackend(t, b, hs, getOnly)
+
+	resp, err := hs.Client().Head(hs.URL + "/" + hex.EncodeToString(emulated[:]) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("emulated: got status %d, want 200", resp.StatusCode)
+	}
+	if resp.ContentLength != 11 {
+		t.Errorf("emulated: got Content-Length %d, want 11", resp.ContentLength)
+	}
+
+	resp, err = hs.Client().Head(hs.URL + "/" + hex.EncodeToString(other[:]) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("not emulated: got status %d, want 405", resp.StatusCode)
+	}
+}
+
+func TestMaxLifetimeConnections(t *testing.T) {
+	b, hs := testBastion(t, &Config{MaxLifetimeConnections: 2})
+	testBackend(t, b, hs, helloHandler)
+	select {
+	case <-b.LifetimeConnectionsReached():
+		t.Fatal("limit reached after one connection")
+	default:
+	}
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	<-b.LifetimeConnectionsReached()
+
+	_, _, done := dialBackend(t, hs, helloHandler)
+	<-done
+	if n := b.AcceptedConnections(); n != 2 {
+		t.Errorf("got %d accepted connections, want 2", n)
+	}
+	if _, body := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/"); body != "hello from /" {
+		t.Errorf("got body %q", body)
+	}
+}
+
+func TestErrorFormatProblemJSON(t *testing.T) {
+	b, hs := testBastion(t, &Config{
+		ErrorFormat: ErrorFormatProblemJSON,
+		FaultInjector: func([sha256.Size]byte, *http.Request) (time.Duration, int, bool) {
+			return 0, http.StatusServiceUnavailable, true
+		},
+	})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+
+	for path, status := range map[string]int{
+		"/not-a-key-hash/":                    http.StatusNotFound,
+		"/" + hex.EncodeToString(kh[:]) + "/": http.StatusServiceUnavailable,
+	} {
+		resp, body := testGet(t, hs, path)
+		if resp.StatusCode != status {
+			t.Errorf("%s: got status %d, want %d", path, resp.StatusCode, status)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s: got Content-Type %q", path, ct)
+		}
+		var problem struct {
+			Type   string
+			Title  string
+			Status int
+			Detail string
+		}
+		if err := json.Unmarshal([]byte(body), &problem); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if problem.Type != "about:blank" || problem.Status != status ||
+			problem.Title != http.StatusText(status) || problem.Detail == "" {
+			t.Errorf("%s: unexpected problem %+v", path, problem)
+		}
+	}
+}
+
+func TestClientACL(t *testing.T) {
+	var denied keyHash
+	b, hs := testBastion(t, &Config{
+		ClientACL: func(kh [sha256.Size]byte, ip net.IP) bool {
+			if ip == nil || !ip.IsLoopback() {
+				t.Errorf("unexpected client IP %v", ip)
+			}
+			return kh != denied
+		},
+	})
+	allowed, _ := testBackend(t, b, hs, helloHandler)
+	denied, _ = testBackend(t, b, hs, helloHandler)
+
+	if resp, body := testGet(t, hs, "/"+hex.EncodeToString(allowed[:])+"/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("allowed: got status %d (%q), want 200", resp.StatusCode, body)
+	}
+	if resp, body := testGet(t, hs, "/"+hex.EncodeToString(denied[:])+"/"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("denied: got status %d (%q), want 403", resp.StatusCode, body)
+	}
+}
+
+func TestClientACLTrustedProxies(t *testing.T) {
+	loopback := netip.MustParsePrefix("127.0.0.0/8")
+	for _, tt := range []struct {
+		name string
+		c    Config
+		want string
+	}{
+		{"untrusted", Config{}, "127.0.0.1"},
+		{"trusted proxy", Config{TrustedProxies: []netip.Prefix{loopback}}, "192.0.2.2"},
+		{"trust headers", Config{TrustForwardedHeaders: true}, "192.0.2.2"},
+		{"rfc7239", Config{ForwardedFormat: ForwardedFormatRFC7239,
+			TrustedProxies: []netip.Prefix{loopback}}, "2001:db8::2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ips := make(chan net.IP, 1)
+			tt.c.ClientACL = func(kh [sha256.Size]byte, ip net.IP) bool {
+				ips <- ip
+				return true
+			}
+			b, hs := testBastion(t, &tt.c)
+			kh, _ := testBackend(t, b, hs, helloHandler)
+			req, err := http.NewRequest("GET", hs.URL+"/"+hex.EncodeToString(kh[:])+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Add("X-Forwarded-For", "192.0.2.1")
+			req.Header.Add("X-Forwarded-For", "198.51.100.1, 192.0.2.2")
+			req.Header.Set("Forwarded", `for=192.0.2.1, for="[2001:db8::2]:4711";proto=https`)
+			resp, err := hs.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if ip := <-ips; ip.String() != tt.want {
+				t.Errorf("got client IP %v, want %s", ip, tt.want)
+			}
+		})
+	}
+}
+
+func TestObserveRequestTiming(t *testing.T) {
+	timings := make(chan RequestTiming, 1)
+	b, hs := testBastion(t, &Config{
+		ObserveRequestTiming: func(_ [sha256.Size]byte, _ *http.Request, t RequestTiming) {
+			timings <- t
+		},
+	})
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(w, "done")
+	}))
+
+	testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/")
+	timing := <-timings
+	if timing.Resolve > timing.FirstByte || timing.FirstByte > timing.Total {
+		t.Errorf("timings out of order: %+v", timing)
+	}
+	if timing.FirstByte < 50*time.Millisecond || timing.Total < 100*time.Millisecond {
+		t.Errorf("timings too short: %+v", timing)
+	}
+}
+
+func TestPause(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	path := "/" + hex.EncodeToString(kh[:]) + "/"
+
+	b.Pause()
+	if resp, _ := testGet(t, hs, path); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("paused: got status %d, want 503", resp.StatusCode)
+	}
+	other, _ := testBackend(t, b, hs, helloHandler)
+	b.Resume()
+	for _, kh := range []keyHash{kh, other} {
+		if resp, _ := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/"); resp.StatusCode != http.StatusOK {
+			t.Errorf("resumed: got status %d, want 200", resp.StatusCode)
+		}
+	}
+}
+
+func TestNoBackendsHandler(t *testing.T) {
+	b, hs := testBastion(t, &Config{
+		NoBackendsHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "no backends", http.StatusTeapot)
+		}),
+	})
+	missing := "/" + strings.Repeat("aa", sha256.Size) + "/"
+
+	if resp, _ := testGet(t, hs, missing); resp.StatusCode != http.StatusTeapot {
+		t.Errorf("no backends: got status %d, want 418", resp.StatusCode)
+	}
+	testBackend(t, b, hs, helloHandler)
+	if resp, _ := testGet(t, hs, missing); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("missing backend: got status %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestUnavailableBackend(t *testing.T) {
+	_, hs := testBastion(t, &Config{})
+	resp, body := testGet(t, hs, "/"+strings.Repeat("aa", sha256.Size)+"/")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want 503", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Errorf("missing Retry-After header")
+	}
+	if body != "backend unavailable\n" {
+		t.Errorf("got body %q", body)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	b, hs := testBastion(t, &Config{})
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "drained")
+	}))
+	path := "/" + hex.EncodeToString(kh[:]) + "/"
+
+	inflight := make(chan string)
+	go func() {
+		resp, err := hs.Client().Get(hs.URL + path)
+		if err != nil {
+			inflight <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		inflight <- string(body)
+	}()
+	<-started
+
+	done := make(chan error)
+	go func() { done <- b.Shutdown(context.Background()) }()
+	waitFor(t, func() bool { return b.pool.shuttingDown.Load() })
+	if resp, _ := testGet(t, hs, path); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("during shutdown: got status %d, want 503", resp.StatusCode)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned early: %v", err)
+	default:
+	}
+
+	close(release)
+	if body := <-inflight; body != "drained" {
+		t.Errorf("in-flight request: got %q", body)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := b.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	b, hs := testBastion(t, &Config{})
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	failed := make(chan error, 1)
+	go func() {
+		resp, err := hs.Client().Get(hs.URL + "/" + hex.EncodeToString(kh[:]) + "/")
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		failed <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown returned %v, want context.DeadlineExceeded", err)
+	}
+	// The connection with the hung request is closed, not left open.
+	waitFor(t, b.pool.empty)
+	waitFor(t, func() bool { return !b.IsConnected(kh) })
+	<-failed
+}
+
+func TestNotifyConnCloseUnresponsive(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := backendCertificate(t, priv.Public().(ed25519.PublicKey), priv)
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	server := tls.Server(c1, &tls.Config{
+		Certificates:           []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: priv}},
+		SessionTicketsDisabled: true,
+	})
+	client := tls.Client(c2, &tls.Config{InsecureSkipVerify: true})
+	errc := make(chan error, 1)
+	go func() { errc <- client.Handshake() }()
+	if err := server.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer never reads, so the close_notify write blocks.
+	nc := &notifyConn{Conn: server, closed: make(chan struct{})}
+	closed := make(chan struct{})
+	go func() {
+		nc.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		c1.Close()
+		t.Fatal("Close blocked on an unresponsive peer")
+	}
+	select {
+	case <-nc.closed:
+	default:
+		t.Error("closed channel was not closed")
+	}
+}
+
+func TestShutdownConcurrentBackends(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	var dones []<-chan struct{}
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			go b.Shutdown(context.Background())
+		}
+		_, _, done := dialBackend(t, hs, helloHandler)
+		dones = append(dones, done)
+	}
+	for _, done := range dones {
+		<-done
+	}
+	if err := b.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, b.pool.empty)
+}
+
+func TestInfoHandler(t *testing.T) {
+	info := func(c *Config) map[string]any {
+		t.Helper()
+		b, _ := testBastion(t, c)
+		rec := httptest.NewRecorder()
+		b.InfoHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/info", nil))
+		var info struct {
+			Config map[string]any `json:"config"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		return info.Config
+	}
+	check := func(got map[string]any, want map[string]any) {
+		t.Helper()
+		for k, v := range want {
+			if fmt.Sprint(got[k]) != fmt.Sprint(v) {
+				t.Errorf("%s: got %v, want %v", k, got[k], v)
+			}
+		}
+	}
+
+	// Defaults are reported as their effective values. IdleTimeout has no
+	// effect without ReapInterval.
+	check(info(&Config{IdleTimeout: time.Minute, RequestsPerSecondPerBackend: 2.5}), map[string]any{
+		"protocols":                           []any{"bastion/0"},
+		"max_backends":                        0,
+		"max_connections_per_backend":         1,
+		"max_concurrent_requests_per_backend": 0,
+		"requests_per_second_per_backend":     2.5,
+		"request_burst_per_backend":           3,
+		"max_request_body_bytes":              0,
+		"request_timeout":                     "0s",
+		"accept_timeout":                      "5s",
+		"ping_interval":                       "15s",
+		"ping_timeout":                        "15s",
+		"reap_interval":                       "0s",
+		"idle_timeout":                        "0s",
+		"max_connection_age":                  "0s",
+		"replaced_connection_drain_timeout":   "1m0s",
+	})
+
+	check(info(&Config{
+		MaxBackends:                     10,
+		MaxConnectionsPerBackend:        3,
+		MaxConcurrentRequestsPerBackend: 20,
+		RequestsPerSecondPerBackend:     5,
+		RequestBurstPerBackend:          50,
+		MaxRequestBodyBytes:             1 << 20,
+		RequestTimeout:                  30 * time.Second,
+		PingInterval:                    time.Minute,
+		PingTimeout:                     2 * time.Second,
+		ReapInterval:                    10 * time.Second,
+		IdleTimeout:                     time.Hour,
+		MaxConnectionAge:                24 * time.Hour,
+		ReplacedConnectionDrainTimeout:  time.Second,
+		MinBackendsForReady:             2,
+	}), map[string]any{
+		"max_backends":                        10,
+		"max_connections_per_backend":         3,
+		"max_concurrent_requests_per_backend": 20,
+		"requests_per_second_per_backend":     5,
+		"request_burst_per_backend":           50,
+		"max_request_body_bytes":              float64(1 << 20),
+		"request_timeout":                     "30s",
+		"accept_timeout":                      "2s",
+		"ping_interval":                       "1m0s",
+		"ping_timeout":                        "2s",
+		"reap_interval":                       "10s",
+		"idle_timeout":                        "1h0m0s",
+		"max_connection_age":                  "24h0m0s",
+		"replaced_connection_drain_timeout":   "1s",
+		"min_backends_for_ready":              2,
+	})
+}
+
+func TestMetricsHandler(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/")
+	testGet(t, hs, "/"+strings.Repeat("aa", sha256.Size)+"/")
+	testGet(t, hs, "/not-a-key-hash/")
+
+	rec := httptest.NewRecorder()
+	b.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		"bastion_backends_connected 1\n",
+		"bastion_backend_connections_accepted_total 1\n",
+		"bastion_backend_connections_rejected_total 0\n",
+		`bastion_requests_total{origin="backend",code="2xx"} 1` + "\n",
+		`bastion_requests_total{origin="backend",code="4xx"} 0` + "\n",
+		`bastion_requests_total{origin="bastion",code="4xx"} 1` + "\n",
+		`bastion_requests_total{origin="bastion",code="5xx"} 1` + "\n",
+		`bastion_synthesized_responses_total{reason="not_found"} 1` + "\n",
+		`bastion_synthesized_responses_total{reason="unavailable"} 1` + "\n",
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("missing %q in metrics:\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestMetricsLifetimeHistogram(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	_, conn := testBackend(t, b, hs, helloHandler)
+	conn.Close()
+	waitFor(t, func() bool { return b.pool.metrics.lifetimes.count.Load() == 1 })
+
+	rec := httptest.NewRecorder()
+	b.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		"# TYPE bastion_backend_connection_lifetime_seconds histogram\n",
+		`bastion_backend_connection_lifetime_seconds_bucket{le="10"} 1` + "\n",
+		`bastion_backend_connection_lifetime_seconds_bucket{le="604800"} 1` + "\n",
+		`bastion_backend_connection_lifetime_seconds_bucket{le="+Inf"} 1` + "\n",
+		"bastion_backend_connection_lifetime_seconds_count 1\n",
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("missing %q in metrics:\n%s", line, rec.Body.String())
+		}
+	}
+
+	var h durationHistogram
+	h.observe(30 * time.Second)
+	h.observe(time.Minute)
+	h.observe(30 * 24 * time.Hour)
+	rec = httptest.NewRecorder()
+	h.write(rec, "x", "x")
+	for _, line := range []string{
+		`x_bucket{le="10"} 0` + "\n",
+		`x_bucket{le="60"} 2` + "\n",
+		`x_bucket{le="604800"} 2` + "\n",
+		`x_bucket{le="+Inf"} 3` + "\n",
+		"x_sum 2.59209e+06\n",
+		"x_count 3\n",
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("missing %q in histogram:\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestMetricsHandlerStatusCodes(t *testing.T) {
+	b, hs := testBastion(t, &Config{StatusCodeMetrics: true})
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/teapot":
+			w.WriteHeader(http.StatusTeapot)
+		case "/unknown":
+			w.WriteHeader(499)
+		}
+	}))
+	testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/")
+	testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/teapot")
+	testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/unknown")
+	testGet(t, hs, "/not-a-key-hash/")
+
+	rec := httptest.NewRecorder()
+	b.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`bastion_responses_by_code_total{origin="backend",code="200"} 1` + "\n",
+		`bastion_responses_by_code_total{origin="backend",code="418"} 1` + "\n",
+		`bastion_responses_by_code_total{origin="backend",code="other"} 1` + "\n",
+		`bastion_responses_by_code_total{origin="bastion",code="404"} 1` + "\n",
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("missing %q in metrics:\n%s", line, rec.Body.String())
+		}
+	}
+
+	b, _ = testBastion(t, &Config{})
+	rec = httptest.NewRecorder()
+	b.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "bastion_responses_by_code_total") {
+		t.Errorf("unexpected per-code metrics without StatusCodeMetrics:\n%s", rec.Body.String())
+	}
+}
+
+func TestConnectedBackends(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	if got := b.ConnectedBackends(); len(got) != 0 {
+		t.Errorf("got %d backends, want none", len(got))
+	}
+	kh1, _ := testBackend(t, b, hs, helloHandler)
+	kh2, conn := testBackend(t, b, hs, helloHandler)
+	got := b.ConnectedBackends()
+	if len(got) != 2 || !slices.Contains(got, [sha256.Size]byte(kh1)) || !slices.Contains(got, [sha256.Size]byte(kh2)) {
+		t.Errorf("got %x, want %x and %x", got, kh1, kh2)
+	}
+	conn.Close()
+	waitFor(t, func() bool { return len(b.ConnectedBackends()) == 1 })
+	if got := b.ConnectedBackends(); got[0] != kh1 {
+		t.Errorf("got %x, want %x", got, kh1)
+	}
+}
+
+func TestConnectHooks(t *testing.T) {
+	type connectEvent struct {
+		kh       [sha256.Size]byte
+		replaced bool
+	}
+	type disconnectEvent struct {
+		kh        [sha256.Size]byte
+		connected time.Duration
+	}
+	connected, disconnected := make(chan connectEvent, 2), make(chan disconnectEvent, 2)
+	_, hs := testBastion(t, &Config{
+		OnBackendConnect: func(kh [sha256.Size]byte, replaced bool) {
+			connected <- connectEvent{kh, replaced}
+		},
+		OnBackendDisconnect: func(kh [sha256.Size]byte, d time.Duration) {
+			disconnected <- disconnectEvent{kh, d}
+		},
+	})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, _, _ := dialBackendWithKey(t, hs, priv, helloHandler)
+	if got := <-connected; got.kh != kh || got.replaced {
+		t.Errorf("OnBackendConnect called with %x, %v, want %x, false", got.kh, got.replaced, kh)
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, conn, _ := dialBackendWithKey(t, hs, priv, helloHandler)
+	if got := <-connected; got.kh != kh || !got.replaced {
+		t.Errorf("OnBackendConnect called with %x, %v, want %x, true", got.kh, got.replaced, kh)
+	}
+	if got := <-disconnected; got.kh != kh || got.connected < 10*time.Millisecond {
+		t.Errorf("OnBackendDisconnect called with %x, %v, want %x, >=10ms", got.kh, got.connected, kh)
+	}
+	conn.Close()
+	if got := <-disconnected; got.kh != kh {
+		t.Errorf("OnBackendDisconnect called with %x, want %x", got.kh, kh)
+	}
+}
+
+func TestConnectHooksReplicas(t *testing.T) {
+	replaced := make(chan bool, 3)
+	b, hs := testBastion(t, &Config{
+		MaxConnectionsPerBackend: 2,
+		OnBackendConnect: func(kh [sha256.Size]byte, r bool) {
+			replaced <- r
+		},
+	})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Connections added alongside the others don't replace any, and only the
+	// one over the limit displaces the oldest.
+	_, _, doneA := dialBackendWithKey(t, hs, priv, helloHandler)
+	for i, want := range []bool{false, false, true} {
+		if i > 0 {
+			dialBackendWithKey(t, hs, priv, helloHandler)
+		}
+		if got := <-replaced; got != want {
+			t.Errorf("connection %d: got replaced %v, want %v", i, got, want)
+		}
+	}
+	<-doneA
+	waitFor(t, func() bool { return b.pool.connected() == 2 })
+}
+
+func TestRejectExcessConnections(t *testing.T) {
+	b, hs := testBastion(t, &Config{MaxConnectionsPerBackend: 2, RejectExcessConnections: true})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, connA, doneA := dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.AcceptedConnections() == 1 })
+	_, _, doneB := dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.AcceptedConnections() == 2 })
+
+	// A third connection is rejected, and the first two stay up.
+	_, _, doneC := dialBackendWithKey(t, hs, priv, helloHandler)
+	<-doneC
+	if n := b.AcceptedConnections(); n != 2 {
+		t.Errorf("got %d accepted connections, want 2", n)
+	}
+	if n := b.pool.metrics.rejected.Load(); n != 1 {
+		t.Errorf("got %d rejected connections, want 1", n)
+	}
+	select {
+	case <-doneA:
+		t.Error("first connection was evicted")
+	case <-doneB:
+		t.Error("second connection was evicted")
+	default:
+	}
+	if _, body := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/"); body != "hello from /" {
+		t.Errorf("got body %q", body)
+	}
+
+	// Once a connection closes, there's room for a new one.
+	connA.Close()
+	<-doneA
+	waitFor(t, func() bool { return b.pool.connected() == 1 })
+	dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.AcceptedConnections() == 3 })
+	if n := b.pool.connected(); n != 2 {
+		t.Errorf("got %d live connections, want 2", n)
+	}
+}
+
+func TestMaxConcurrentRequestsPerBackend(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	b, hs := testBastion(t, &Config{MaxConcurrentRequestsPerBackend: 1})
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			close(started)
+			<-release
+		}
+		io.WriteString(w, "ok")
+	}))
+	prefix := "/" + hex.EncodeToString(kh[:])
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := hs.Client().Get(hs.URL + prefix + "/block"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	if resp, _ := testGet(t, hs, prefix+"/"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("over limit: got status %d, want 429", resp.StatusCode)
+	}
+	close(release)
+	<-done
+	if resp, _ := testGet(t, hs, prefix+"/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("after release: got status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestNotFoundHandler(t *testing.T) {
+	b, hs := testBastion(t, &Config{
+		NotFoundHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "landing page "+r.URL.Path)
+		}),
+	})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+
+	if _, body := testGet(t, hs, "/about"); body != "landing page /about" {
+		t.Errorf("got body %q", body)
+	}
+	if _, body := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/about"); body != "hello from /about" {
+		t.Errorf("got body %q", body)
+	}
+}
+
+func TestMaxReconnects(t *testing.T) {
+	p := &backendConnectionsPool{
+		c:     &Config{MaxReconnects: 2, ReconnectWindow: time.Minute, ReconnectCooldown: time.Hour},
+		flaps: make(map[keyHash]*flapState),
+	}
+	kh, other := keyHash{1}, keyHash{2}
+	now := time.Now()
+	for i, want := range []bool{true, true, false, false} {
+		if ok, _ := p.allowConnect(kh, now.Add(time.Duration(i)*time.Second)); ok != want {
+			t.Errorf("connection %d: got %v, want %v", i, ok, want)
+		}
+	}
+	if ok, _ := p.allowConnect(other, now); !ok {
+		t.Errorf("other backend was rejected")
+	}
+	if ok, until := p.allowConnect(kh, now.Add(30*time.Minute)); ok || !until.Equal(now.Add(2*time.Second+time.Hour)) {
+		t.Errorf("during cooldown: got %v, %v", ok, until)
+	}
+	if ok, _ := p.allowConnect(kh, now.Add(2*time.Hour)); !ok {
+		t.Errorf("after cooldown: rejected")
+	}
+}
+
+func TestMaxBackends(t *testing.T) {
+	l := &testLog{t: t}
+	b, hs := testBastion(t, &Config{MaxBackends: 1, Log: log.New(l, "", 0)})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, _, _ := dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.AcceptedConnections() == 1 })
+
+	_, _, done := dialBackend(t, hs, helloHandler)
+	<-done
+	if !strings.Contains(l.String(), "reached limit of 1 backends") {
+		t.Errorf("missing rejection log line:\n%s", l)
+	}
+
+	// A reconnection from the same backend replaces the existing connection.
+	dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.AcceptedConnections() == 2 })
+	if _, body := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/"); body != "hello from /" {
+		t.Errorf("got body %q", body)
+	}
+}
+
+func TestForceDisconnect(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, _, done := dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.AcceptedConnections() == 1 })
+	path := "/" + hex.EncodeToString(kh[:]) + "/"
+
+	if b.ForceDisconnect(keyHash{}) {
+		t.Errorf("disconnected a backend that was not connected")
+	}
+	if !b.ForceDisconnect(kh) {
+		t.Fatal("backend was not found")
+	}
+	<-done
+	if resp, _ := testGet(t, hs, path); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("after disconnect: got status %d, want 503", resp.StatusCode)
+	}
+
+	dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return len(b.ConnectedBackends()) == 1 })
+	if _, body := testGet(t, hs, path); body != "hello from /" {
+		t.Errorf("after reconnect: got body %q", body)
+	}
+}
+
+func TestParseKeyHash(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	b32 := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(kh[:])
+	for _, segment := range []string{
+		hex.EncodeToString(kh[:]),
+		strings.ToUpper(hex.EncodeToString(kh[:])),
+		b32,
+		strings.ToLower(b32),
+	} {
+		if got, ok := parseKeyHash(segment); !ok || got != kh {
+			t.Errorf("%s: got %x, %v", segment, got, ok)
+		}
+		if _, body := testGet(t, hs, "/"+segment+"/foo"); body != "hello from /foo" {
+			t.Errorf("%s: got body %q", segment, body)
+		}
+	}
+	for _, segment := range []string{
+		"",
+		hex.EncodeToString(kh[:31]),
+		b32 + "A",
+		b32[:51] + "1",
+		hex.EncodeToString(kh[:])[:63] + "g",
+		base32.StdEncoding.EncodeToString(kh[:]),
+	} {
+		if _, ok := parseKeyHash(segment); ok {
+			t.Errorf("%q: unexpectedly accepted", segment)
+		}
+	}
+	if resp, _ := testGet(t, hs, "/"+b32[:51]+"1/"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	b, hs := testBastion(t, &Config{RequestTimeout: 100 * time.Millisecond})
+	release := make(chan struct{})
+	defer close(release)
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		io.WriteString(w, "hello from "+r.URL.Path)
+	}))
+	prefix := "/" + hex.EncodeToString(kh[:])
+
+	if _, body := testGet(t, hs, prefix+"/fast"); body != "hello from /fast" {
+		t.Errorf("got body %q", body)
+	}
+	resp, _ := testGet(t, hs, prefix+"/slow")
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("got status %d, want 504", resp.StatusCode)
+	}
+}
+
+func TestAdmitBackend(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := sha256.Sum256(priv.Public().(ed25519.PublicKey))
+	l := &testLog{t: t}
+	b, hs := testBastion(t, &Config{
+		Log: log.New(l, "", 0),
+		AdmitBackend: func(kh [sha256.Size]byte) (BackendPolicy, bool) {
+			return BackendPolicy{Name: "alpha"}, kh == allowed
+		},
+		// AllowedBackend is set by testBastion, and must be ignored.
+	})
+
+	_, _, done := dialBackend(t, hs, helloHandler)
+	<-done
+	if n := b.AcceptedConnections(); n != 0 {
+		t.Errorf("got %d accepted connections, want 0", n)
+	}
+
+	dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.AcceptedConnections() == 1 })
+	if want := hex.EncodeToString(allowed[:]) + ": accepted new backend connection (alpha)"; !strings.Contains(l.String(), want) {
+		t.Errorf("missing %q in log:\n%s", want, l)
+	}
+}
+
+func TestStructuredLogger(t *testing.T) {
+	l := &testLog{t: t}
+	b, hs := testBastion(t, &Config{Logger: slog.New(slog.NewJSONHandler(l, nil))})
+	kh, conn := testBackend(t, b, hs, helloHandler)
+	conn.Close()
+	waitFor(t, func() bool { return strings.Contains(l.String(), `"event":"expired"`) })
+
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(l.String()), "\n") {
+		var r struct {
+			Backend  string
+			Event    string
+			Duration *int64
+		}
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		if r.Backend != hex.EncodeToString(kh[:]) {
+			t.Errorf("got backend %q in %q", r.Backend, line)
+		}
+		if (r.Event == "expired") != (r.Duration != nil) {
+			t.Errorf("unexpected duration attribute in %q", line)
+		}
+		events = append(events, r.Event)
+	}
+	if want := []string{"connected", "expired"}; !slices.Equal(events, want) {
+		t.Errorf("got events %v, want %v", events, want)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	b, hs := testBastion(t, &Config{
+		ReapInterval: 10 * time.Millisecond,
+		IdleTimeout:  200 * time.Millisecond,
+	})
+	kh, _, done := dialBackend(t, hs, helloHandler)
+	waitFor(t, func() bool { return b.AcceptedConnections() == 1 })
+	path := "/" + hex.EncodeToString(kh[:]) + "/"
+	for range 5 {
+		if _, body := testGet(t, hs, path); body != "hello from /" {
+			t.Fatalf("got body %q", body)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("connection in use was closed")
+	default:
+	}
+	<-done
+	if resp, _ := testGet(t, hs, path); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("after idle timeout: got status %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	for _, trust := range []bool{false, true} {
+		b, hs := testBastion(t, &Config{TrustForwardedHeaders: trust})
+		kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Header.Get("X-Forwarded-For")+" "+r.Header.Get("X-Forwarded-Host"))
+		}))
+		req, err := http.NewRequest("GET", hs.URL+"/"+hex.EncodeToString(kh[:])+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		req.Header.Set("X-Forwarded-Host", "spoofed.example")
+		resp, err := hs.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "127.0.0.1 " + req.Host
+		if trust {
+			want = "192.0.2.1, " + want
+		}
+		if string(body) != want {
+			t.Errorf("trust=%v: got %q, want %q", trust, body, want)
+		}
+	}
+}
+
+func TestForwardingPolicy(t *testing.T) {
+	loopback := netip.MustParsePrefix("127.0.0.0/8")
+	other := netip.MustParsePrefix("192.0.2.0/24")
+	for _, tt := range []struct {
+		name   string
+		c      Config
+		header string
+		want   string
+	}{
+		{"trusted proxy", Config{TrustedProxies: []netip.Prefix{other, loopback}},
+			"X-Forwarded-For", "192.0.2.1, 127.0.0.1"},
+		{"untrusted proxy", Config{TrustedProxies: []netip.Prefix{other}},
+			"X-Forwarded-For", "127.0.0.1"},
+		{"rfc7239", Config{ForwardedFormat: ForwardedFormatRFC7239},
+			"Forwarded", `for=127.0.0.1;host="127.0.0.1:PORT";proto=https`},
+		{"rfc7239 trusted", Config{ForwardedFormat: ForwardedFormatRFC7239, TrustedProxies: []netip.Prefix{loopback}},
+			"Forwarded", `for=192.0.2.1, for=127.0.0.1;host="127.0.0.1:PORT";proto=https`},
+		{"rfc7239 no xff", Config{ForwardedFormat: ForwardedFormatRFC7239},
+			"X-Forwarded-For", ""},
+		{"none", Config{ForwardedFormat: ForwardedFormatNone, TrustForwardedHeaders: true},
+			"X-Forwarded-For", ""},
+		{"none forwarded", Config{ForwardedFormat: ForwardedFormatNone},
+			"Forwarded", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b, hs := testBastion(t, &tt.c)
+			kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, strings.Join(r.Header.Values(tt.header), ", "))
+			}))
+			req, err := http.NewRequest("GET", hs.URL+"/"+hex.EncodeToString(kh[:])+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Forwarded-For", "192.0.2.1")
+			req.Header.Set("Forwarded", "for=192.0.2.1")
+			resp, err := hs.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.ReplaceAll(tt.want, "127.0.0.1:PORT", req.Host)
+			if string(body) != want {
+				t.Errorf("got %s %q, want %q", tt.header, body, want)
+			}
+		})
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	b, hs := testBastion(t, &Config{FlushInterval: -1})
+	release := make(chan struct{})
+	defer close(release)
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		io.WriteString(w, "hello")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "world")
+	}))
+	resp, err := hs.Client().Get(hs.URL + "/" + hex.EncodeToString(kh[:]) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("got %q, want %q", buf, "hello")
+	}
+}
+
+func TestStreamingResponses(t *testing.T) {
+	b, hs := testBastion(t, &Config{
+		FlushImmediately: func(_ [sha256.Size]byte, r *http.Request) bool {
+			return r.URL.Path == "/tail"
+		},
+	})
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/events":
+			// A never-ending chunked event stream.
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := 0; ; i++ {
+				if _, err := fmt.Fprintf(w, "data: %d\n\n", i); err != nil {
+					return
+				}
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		case "/tail":
+			// A long-poll response with a Content-Length, which would
+			// otherwise be buffered until FlushInterval.
+			w.Header().Set("Content-Length", "10")
+			io.WriteString(w, "hello")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	base := hs.URL + "/" + hex.EncodeToString(kh[:])
+
+	resp, err := hs.Client().Get(base + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("data: 0\n\ndata: 1\n\n"))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "data: 0\n\ndata: 1\n\n" {
+		t.Errorf("got %q", buf)
+	}
+	resp.Body.Close()
+
+	resp, err = hs.Client().Get(base + "/tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("got %q, want %q", buf, "hello")
+	}
+	resp.Body.Close()
+
+	// Closing the client response releases the backend streams.
+	waitFor(t, func() bool { return b.BackendInFlight(kh) == 0 })
+}
+
+func TestStatusHandler(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/")
+
+	rec := httptest.NewRecorder()
+	b.StatusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	var status struct {
+		Backends []struct {
+			KeyHash          string `json:"key_hash"`
+			Closed           bool   `json:"closed"`
+			Requests         int64  `json:"requests"`
+			Streams          int    `json:"streams"`
+			HandshakePingRTT string `json:"handshake_ping_rtt"`
+			Connections      int    `json:"connections"`
+		} `json:"backends"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Backends) != 1 {
+		t.Fatalf("got %d backends, want 1", len(status.Backends))
+	}
+	if s := status.Backends[0]; s.KeyHash != hex.EncodeToString(kh[:]) || s.Closed || s.Requests != 1 ||
+		s.Streams != 0 || s.Connections != 1 {
+		t.Errorf("got %+v", s)
+	}
+	if rtt, err := time.ParseDuration(status.Backends[0].HandshakePingRTT); err != nil || rtt <= 0 {
+		t.Errorf("got handshake ping RTT %q, %v", status.Backends[0].HandshakePingRTT, err)
+	}
+
+	if info, ok := b.ConnectionTLS(kh); !ok || info.Version != tls.VersionTLS13 ||
+		info.CipherSuite == 0 || info.NegotiatedProtocol != "bastion/0" {
+		t.Errorf("got TLS info %+v, %v", info, ok)
+	}
+	if !strings.Contains(rec.Body.String(), `"tls_version":"TLS 1.3"`) {
+		t.Errorf("missing TLS version in %s", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	b.StatusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/?format=text", nil))
+	if want := hex.EncodeToString(kh[:]) + " connected for"; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("missing %q in:\n%s", want, rec.Body)
+	}
+}
+
+func TestMaxReadFrameSize(t *testing.T) {
+	// If unset, the http2.Transport default of 16KiB applies.
+	b, _ := testBastion(t, &Config{})
+	if got := b.pool.transport().MaxReadFrameSize; got != 0 {
+		t.Errorf("default MaxReadFrameSize is %d, want 0", got)
+	}
+
+	b, hs := testBastion(t, &Config{MaxReadFrameSize: 1 << 20})
+	if got := b.pool.transport().MaxReadFrameSize; got != 1<<20 {
+		t.Errorf("MaxReadFrameSize is %d, want %d", got, 1<<20)
+	}
+	large := strings.Repeat("x", 4<<20)
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, large)
+	}))
+	if _, body := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/"); body != large {
+		t.Errorf("got %d bytes, want %d", len(body), len(large))
+	}
+}
+
+func TestCertificateChange(t *testing.T) {
+	l := &testLog{t: t}
+	b, hs := testBastion(t, &Config{Log: log.New(l, "", 0)})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, conn, done := dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.AcceptedConnections() == 1 })
+	conn.Close()
+	<-done
+	if strings.Contains(l.String(), "certificate changed") {
+		t.Errorf("certificate change logged on first connection:\n%s", l)
+	}
+
+	kh, _, _ := dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.AcceptedConnections() == 2 })
+	if want := hex.EncodeToString(kh[:]) + ": backend certificate changed"; !strings.Contains(l.String(), want) {
+		t.Errorf("missing %q in log:\n%s", want, l)
+	}
+}
+
+func TestConnectedSince(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	before := time.Now()
+	kh, conn := testBackend(t, b, hs, helloHandler)
+	if !b.IsConnected(kh) {
+		t.Error("backend is not connected")
+	}
+	if since, ok := b.ConnectedSince(kh); !ok || since.Before(before) || since.After(time.Now()) {
+		t.Errorf("got %v, %v", since, ok)
+	}
+	if b.IsConnected(keyHash{}) {
+		t.Error("unknown backend is connected")
+	}
+	conn.Close()
+	waitFor(t, func() bool { return !b.IsConnected(kh) })
+	if _, ok := b.ConnectedSince(kh); ok {
+		t.Error("disconnected backend has a connection time")
+	}
+}
+
+func TestDraining(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	b.SetDraining(true)
+
+	other, _, done := dialBackend(t, hs, helloHandler)
+	<-done
+	if n := b.AcceptedConnections(); n != 1 {
+		t.Errorf("got %d accepted connections, want 1", n)
+	}
+	if _, body := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/"); body != "hello from /" {
+		t.Errorf("connected backend: got body %q", body)
+	}
+	if resp, _ := testGet(t, hs, "/"+hex.EncodeToString(other[:])+"/"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("new backend: got status %d, want 503", resp.StatusCode)
+	}
+
+	b.SetDraining(false)
+	testBackend(t, b, hs, helloHandler)
+}
+
+func TestErrorHandler(t *testing.T) {
+	errs := make(chan error, 1)
+	b, hs := testBastion(t, &Config{
+		RequestTimeout: 50 * time.Millisecond,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			errs <- err
+			w.WriteHeader(http.StatusTeapot)
+		},
+	})
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	if resp, _ := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/"); resp.StatusCode != http.StatusTeapot {
+		t.Errorf("got status %d, want 418", resp.StatusCode)
+	}
+	if err := <-errs; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want DeadlineExceeded", err)
+	}
+
+	// Errors generated by the bastion don't reach the ErrorHandler.
+	if resp, _ := testGet(t, hs, "/"+strings.Repeat("00", sha256.Size)+"/"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unknown backend: got status %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestMaxRequestBodyBytes(t *testing.T) {
+	b, hs := testBastion(t, &Config{MaxRequestBodyBytes: 10})
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "got %d bytes", len(body))
+	}))
+	url := hs.URL + "/" + hex.EncodeToString(kh[:]) + "/"
+
+	for _, tt := range []struct {
+		name   string
+		body   io.Reader
+		status int
+	}{
+		{"empty", nil, http.StatusOK},
+		{"small", strings.NewReader("hello"), http.StatusOK},
+		{"declared", strings.NewReader("hello, world"), http.StatusRequestEntityTooLarge},
+		{"streamed", io.MultiReader(strings.NewReader("hello, world")), http.StatusRequestEntityTooLarge},
+	} {
+		resp, err := hs.Client().Post(url, "text/plain", tt.body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestBackendPolicyLimits(t *testing.T) {
+	var big keyHash
+	b, hs := testServer(t, context.Background(), &Config{
+		MaxRequestBodyBytes: 10,
+		AdmitBackend: func(kh [sha256.Size]byte) (BackendPolicy, bool) {
+			if kh == big {
+				return BackendPolicy{MaxRequestBodyBytes: -1}, true
+			}
+			return BackendPolicy{MaxRequestBodyBytes: 3}, true
+		},
+	})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big = keyHash(sha256.Sum256(priv.Public().(ed25519.PublicKey)))
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	})
+	_, _, _ = dialBackendWithKey(t, hs, priv, echo)
+	small, _ := testBackend(t, b, hs, echo)
+	waitFor(t, func() bool { return b.IsConnected(big) })
+
+	for _, tt := range []struct {
+		kh     keyHash
+		body   string
+		status int
+	}{
+		{small, "hi", http.StatusOK},
+		{small, "hello", http.StatusRequestEntityTooLarge},
+		{big, "hello, world, this is long", http.StatusOK},
+	} {
+		resp, err := hs.Client().Post(hs.URL+"/"+hex.EncodeToString(tt.kh[:])+"/", "text/plain", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%x with %d bytes: got status %d, want %d", tt.kh[:4], len(tt.body), resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestNewWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b, hs := testBastionWithContext(t, ctx, &Config{})
+
+	kh, _, done := dialBackend(t, hs, helloHandler)
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+	cancel()
+	<-done
+	if resp, _ := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("after cancel: got status %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestExpiredDuration(t *testing.T) {
+	l := &testLog{t: t}
+	b, hs := testBastion(t, &Config{Log: log.New(l, "", 0)})
+	kh, conn := testBackend(t, b, hs, helloHandler)
+	conn.Close()
+	want := hex.EncodeToString(kh[:]) + ": backend connection expired after 0s"
+	waitFor(t, func() bool { return strings.Contains(l.String(), want) })
+}
+
+func TestCanRetry(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	b.pool.RLock()
+	bc := b.pool.conns[kh]
+	b.pool.RUnlock()
+
+	// Make sure the unexported x/net/http2 errors are still recognized.
+	bc.cc.(*http2.ClientConn).SetDoNotReuse()
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	_, err := bc.cc.RoundTrip(req)
+	if err == nil {
+		t.Fatal("RoundTrip on unusable connection succeeded")
+	}
+	if !canRetry(req, err) {
+		t.Errorf("error %q is not retryable", err)
+	}
+
+	post := httptest.NewRequest("POST", "https://example.com/", strings.NewReader("body"))
+	if canRetry(post, err) {
+		t.Errorf("request with body is retryable")
+	}
+	refused := http2.StreamError{StreamID: 1, Code: http2.ErrCodeRefusedStream}
+	if !canRetry(req, fmt.Errorf("wrapped: %w", refused)) {
+		t.Errorf("refused stream is not retryable")
+	}
+	if canRetry(req, http2.StreamError{StreamID: 1, Code: http2.ErrCodeInternal}) {
+		t.Errorf("internal error is retryable")
+	}
+}
+
+func TestMisSignedCertificate(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	cert := backendCertificate(t, pub, other)
+	if err := b.verifyBackend(testConnectionState(t, cert)); err == nil ||
+		!strings.Contains(err.Error(), "not self-signed") {
+		t.Errorf("got error %v, want not self-signed", err)
+	}
+	_, _, done := dialBackendWithCert(t, hs, cert, priv, helloHandler)
+	<-done
+	if n := b.AcceptedConnections(); n != 0 {
+		t.Errorf("got %d accepted connections, want 0", n)
+	}
+
+	cert = backendCertificate(t, pub, priv)
+	if err := b.verifyBackend(testConnectionState(t, cert)); err != nil {
+		t.Errorf("self-signed certificate rejected: %v", err)
+	}
+}
+
+func testConnectionState(t *testing.T, cert []byte) tls.ConnectionState {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+}
+
+func TestMalformedClientCertificate(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	if err := b.verifyBackend(tls.ConnectionState{}); err == nil ||
+		!strings.Contains(err.Error(), "missing client certificate") {
+		t.Errorf("got error %v for empty chain, want missing client certificate", err)
+	}
+	if err := b.verifyBackend(tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{nil}}); err == nil {
+		t.Error("nil leaf accepted")
+	}
+
+	// A chain that doesn't parse is rejected during the handshake.
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := tlsDialBackend(hs, []byte("not a certificate"), priv, "bastion/0"); err == nil {
+		// In TLS 1.3 the client may only learn of the rejection on read.
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+		if err == nil {
+			t.Error("malformed certificate accepted")
+		}
+	}
+	if n := b.AcceptedConnections(); n != 0 {
+		t.Errorf("got %d accepted connections, want 0", n)
+	}
+
+	// handleBackend must not panic if it's reached without a certificate.
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	b.pool.handleBackend(hs.Config, tls.Server(c1, &tls.Config{}), nil)
+	if n := b.AcceptedConnections(); n != 0 {
+		t.Errorf("got %d accepted connections, want 0", n)
+	}
+}
+
+func TestProtocols(t *testing.T) {
+	if _, err := New(&Config{Protocols: []string{"bastion/0", "bastion/1"}}); err == nil {
+		t.Fatal("unimplemented bastion/1 protocol was accepted by New")
+	}
+
+	// Register a handler for bastion/1 to test negotiation.
+	protocolHandlers["bastion/1"] = func(p *backendConnectionsPool, hs *http.Server, c *tls.Conn, h http.Handler) {
+		p.handleBackend(hs, c, h)
+	}
+	t.Cleanup(func() { delete(protocolHandlers, "bastion/1") })
+	b, hs := testBastion(t, &Config{Protocols: []string{"bastion/0", "bastion/1"}})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	kh := keyHash(sha256.Sum256(pub))
+	cert := backendCertificate(t, pub, priv)
+
+	conn, err := tlsDialBackend(hs, cert, priv, "bastion/2", "bastion/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if p := conn.ConnectionState().NegotiatedProtocol; p != "bastion/1" {
+		t.Errorf("negotiated %q, want bastion/1", p)
+	}
+	go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: helloHandler})
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+	if info, _ := b.ConnectionTLS(kh); info.NegotiatedProtocol != "bastion/1" {
+		t.Errorf("recorded protocol %q, want bastion/1", info.NegotiatedProtocol)
+	}
+	if _, body := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/"); body != "hello from /" {
+		t.Errorf("got body %q", body)
+	}
+
+	if conn, err := tlsDialBackend(hs, cert, priv, "bastion/2"); err == nil {
+		conn.Close()
+		t.Error("unknown bastion protocol was accepted")
+	}
+}
+
+func TestVersionedPaths(t *testing.T) {
+	protocolHandlers["bastion/1"] = func(p *backendConnectionsPool, hs *http.Server, c *tls.Conn, h http.Handler) {
+		p.handleBackend(hs, c, h)
+	}
+	t.Cleanup(func() { delete(protocolHandlers, "bastion/1") })
+	b, hs := testBastion(t, &Config{
+		Protocols:                []string{"bastion/0", "bastion/1"},
+		MaxConnectionsPerBackend: 2,
+	})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	kh := keyHash(sha256.Sum256(pub))
+	cert := backendCertificate(t, pub, priv)
+	conns := make(map[string]*tls.Conn)
+	for _, proto := range []string{"bastion/0", "bastion/1"} {
+		conn, err := tlsDialBackend(hs, cert, priv, proto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conns[proto] = conn
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", proto, r.URL.Path)
+		})
+		go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: h})
+	}
+	waitFor(t, func() bool { return b.pool.connected() == 2 })
+
+	khHex := hex.EncodeToString(kh[:])
+	if resp, _ := testGet(t, hs, "/"+khHex+"/foo"); resp.StatusCode != http.StatusOK {
+		t.Errorf("unversioned path: got status %d", resp.StatusCode)
+	}
+	for _, tt := range []struct{ path, body string }{
+		{"/v0/" + khHex + "/foo", "bastion/0 /foo"},
+		{"/v1/" + khHex + "/foo", "bastion/1 /foo"},
+	} {
+		for range 3 {
+			if _, body := testGet(t, hs, tt.path); body != tt.body {
+				t.Errorf("%s: got %q, want %q", tt.path, body, tt.body)
+			}
+		}
+	}
+	for _, path := range []string{"/v2/" + khHex + "/", "/v01/" + khHex + "/", "/v1/", "/v/" + khHex + "/"} {
+		if resp, _ := testGet(t, hs, path); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want 404", path, resp.StatusCode)
+		}
+	}
+	// The bare key hash is redirected to its versioned root.
+	if _, body := testGet(t, hs, "/v1/"+khHex); body != "bastion/1 /" {
+		t.Errorf("bare versioned key hash: got %q", body)
+	}
+
+	conns["bastion/1"].Close()
+	waitFor(t, func() bool { return b.pool.connected() == 1 })
+	if resp, _ := testGet(t, hs, "/v1/"+khHex+"/"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("disconnected version: got status %d, want 503", resp.StatusCode)
+	}
+	if _, body := testGet(t, hs, "/v0/"+khHex+"/"); body != "bastion/0 /" {
+		t.Errorf("got %q after the bastion/1 connection closed", body)
+	}
+}
+
+func TestBackendForRequest(t *testing.T) {
+	var hosted keyHash
+	rand.Read(hosted[:])
+	b, hs := testBastion(t, &Config{
+		BackendForHost: func(host string) ([sha256.Size]byte, bool) {
+			return hosted, host == "backend.example"
+		},
+	})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+
+	var seen []keyHash
+	middleware := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if kh, ok := b.BackendForRequest(r); ok {
+			seen = append(seen, kh)
+		}
+		b.ServeHTTP(w, r)
+	})
+	for _, target := range []string{
+		"/" + hex.EncodeToString(kh[:]) + "/foo",
+		"/v0/" + hex.EncodeToString(kh[:]) + "/foo",
+		"/" + strings.ToLower(base32NoPadding.EncodeToString(kh[:])) + "/foo",
+	} {
+		seen = nil
+		rec := httptest.NewRecorder()
+		middleware.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Body.String() != "hello from /foo" {
+			t.Errorf("%s: got body %q", target, rec.Body)
+		}
+		if len(seen) != 1 || seen[0] != kh {
+			t.Errorf("%s: middleware saw %x, want %x", target, seen, kh)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "http://backend.example/foo", nil)
+	if got, ok := b.BackendForRequest(req); !ok || got != hosted {
+		t.Errorf("host-mapped backend: got %x, %v", got, ok)
+	}
+	for _, target := range []string{"/", "/not-a-key-hash/", "/v2/" + hex.EncodeToString(kh[:]) + "/"} {
+		if got, ok := b.BackendForRequest(httptest.NewRequest("GET", target, nil)); ok {
+			t.Errorf("%s: got backend %x", target, got)
+		}
+	}
+}
+
+func TestRewriteRequest(t *testing.T) {
+	b, hs := testBastion(t, &Config{
+		RewriteRequest: func(pr *httputil.ProxyRequest) {
+			kh, _ := BackendFromContext(pr.In.Context())
+			pr.Out.URL.Path = "/base" + pr.Out.URL.Path
+			pr.Out.Header.Set("X-Bastion-Backend", hex.EncodeToString(kh[:4]))
+			pr.Out.URL.Scheme = "http"
+			pr.Out.Host = "example.com"
+		},
+	})
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.URL.Path, r.Header.Get("X-Bastion-Backend"), r.Host)
+	}))
+	khHex := hex.EncodeToString(kh[:])
+	want := "/base/foo " + khHex[:8] + " " + khHex
+	if _, body := testGet(t, hs, "/"+khHex+"/foo"); body != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+}
+
+// fakeClientConn is a clientConn that serves every request with helloHandler,
+// and that can be closed without a network connection.
+type fakeClientConn struct {
+	nc     net.Conn
+	closed atomic.Bool
+}
+
+func (f *fakeClientConn) RoundTrip(r *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	helloHandler.ServeHTTP(rec, r)
+	return rec.Result(), nil
+}
+
+func (f *fakeClientConn) Ping(context.Context) error { return nil }
+
+func (f *fakeClientConn) State() http2.ClientConnState {
+	return http2.ClientConnState{Closed: f.closed.Load()}
+}
+
+func (f *fakeClientConn) Shutdown(context.Context) error { return f.Close() }
+
+func (f *fakeClientConn) Close() error {
+	f.closed.Store(true)
+	return f.nc.Close()
+}
+
+// refusingClientConn is a fakeClientConn that fails the first request with a
+// retryable error, once proceed is closed.
+type refusingClientConn struct {
+	*fakeClientConn
+	entered, proceed chan struct{}
+}
+
+func (f *refusingClientConn) RoundTrip(r *http.Request) (*http.Response, error) {
+	close(f.entered)
+	<-f.proceed
+	return nil, errors.New("http2: client conn not usable")
+}
+
+func TestRetryOnNewConnection(t *testing.T) {
+	first := &refusingClientConn{entered: make(chan struct{}), proceed: make(chan struct{})}
+	second := make(chan *fakeClientConn, 1)
+	var n atomic.Int32
+	b, hs := testBastion(t, &Config{
+		MaxConcurrentRequestsPerBackend: 1,
+		newClientConn: func(nc net.Conn) (clientConn, error) {
+			f := &fakeClientConn{nc: nc}
+			if n.Add(1) == 1 {
+				first.fakeClientConn = f
+				return first, nil
+			}
+			second <- f
+			return f, nil
+		},
+	})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, _, _ := dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+
+	body := make(chan string)
+	go func() {
+		resp, err := hs.Client().Get(hs.URL + "/" + hex.EncodeToString(kh[:]) + "/foo")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+	<-first.entered
+	b.pool.RLock()
+	firstInFlight := b.pool.conns[kh].inflight
+	b.pool.RUnlock()
+
+	// The first connection goes away while the request is on it, and the
+	// backend reconnects, so the new connection has its own in-flight counter.
+	first.Close()
+	waitFor(t, func() bool { return !b.IsConnected(kh) })
+	dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+	close(first.proceed)
+
+	if got := <-body; got != "hello from /foo" {
+		t.Errorf("got %q, want the response from the new connection", got)
+	}
+	waitFor(t, func() bool { return b.InFlight() == 0 })
+	if n := b.BackendInFlight(kh); n != 0 {
+		t.Errorf("got %d requests in flight to the backend, want 0", n)
+	}
+	if n := firstInFlight.Load(); n != 0 {
+		t.Errorf("got %d requests in flight on the first connection, want 0", n)
+	}
+	(<-second).Close()
+}
+
+func TestReapClosed(t *testing.T) {
+	conns := make(chan *fakeClientConn, 1)
+	b, hs := testBastion(t, &Config{
+		// Don't let the reaper run on its own, and call reap directly.
+		ReapInterval: time.Hour,
+		newClientConn: func(nc net.Conn) (clientConn, error) {
+			f := &fakeClientConn{nc: nc}
+			conns <- f
+			return f, nil
+		},
+	})
+	kh, _, _ := dialBackend(t, hs, helloHandler)
+	f := <-conns
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+	if _, body := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/foo"); body != "hello from /foo" {
+		t.Errorf("got body %q", body)
+	}
+
+	// Mark the connection closed without closing the net.Conn, so that
+	// handleBackend doesn't notice, and only the reaper can remove it.
+	f.closed.Store(true)
+	b.pool.reap(time.Now())
+	b.pool.RLock()
+	_, ok := b.pool.conns[kh]
+	b.pool.RUnlock()
+	if ok {
+		t.Error("closed connection was not reaped")
+	}
+	f.Close()
+}
+
+// stuckClientConn is a fakeClientConn whose Shutdown never completes, as if
+// a request were still in flight.
+type stuckClientConn struct {
+	*fakeClientConn
+}
+
+func (s stuckClientConn) Shutdown(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestReapIdleDrainTimeout(t *testing.T) {
+	conns := make(chan *fakeClientConn, 1)
+	b, hs := testBastion(t, &Config{
+		ReapInterval:                   time.Hour,
+		IdleTimeout:                    time.Minute,
+		ReplacedConnectionDrainTimeout: 50 * time.Millisecond,
+		newClientConn: func(nc net.Conn) (clientConn, error) {
+			f := &fakeClientConn{nc: nc}
+			conns <- f
+			return stuckClientConn{f}, nil
+		},
+	})
+	kh, _, done := dialBackend(t, hs, helloHandler)
+	f := <-conns
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+
+	start := time.Now()
+	b.pool.reap(start.Add(2 * time.Minute))
+	if b.IsConnected(kh) {
+		t.Error("idle connection was not removed")
+	}
+	// The idle connection is closed after ReplacedConnectionDrainTimeout,
+	// rather than a hardcoded timeout.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection was not closed after the drain timeout")
+	}
+	if !f.closed.Load() {
+		t.Error("idle connection was not closed")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("idle connection closed after %v, before the drain timeout", d)
+	}
+}
+
+func TestRetryAfterCooldown(t *testing.T) {
+	b, hs := testBastion(t, &Config{MaxReconnects: 1, ReconnectCooldown: 90 * time.Second})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, conn, done := dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+	path := "/" + hex.EncodeToString(kh[:]) + "/"
+	conn.Close()
+	<-done
+	waitFor(t, func() bool { return !b.IsConnected(kh) })
+	if resp, _ := testGet(t, hs, path); resp.Header.Get("Retry-After") != retryAfterUnavailable {
+		t.Errorf("got Retry-After %q, want default", resp.Header.Get("Retry-After"))
+	}
+
+	_, _, done = dialBackendWithKey(t, hs, priv, helloHandler)
+	<-done
+	if resp, _ := testGet(t, hs, path); resp.Header.Get("Retry-After") != "90" {
+		t.Errorf("got Retry-After %q, want 90", resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestReplacedConnectionDrainTimeout(t *testing.T) {
+	l := &testLog{t: t}
+	b, hs := testBastion(t, &Config{
+		ReplacedConnectionDrainTimeout: 50 * time.Millisecond,
+		Log:                            log.New(l, "", 0),
+	})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	kh, _, done := dialBackendWithKey(t, hs, priv, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+
+	errc := make(chan error, 1)
+	go func() {
+		resp, err := hs.Client().Get(hs.URL + "/" + hex.EncodeToString(kh[:]) + "/")
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		errc <- err
+	}()
+	<-started
+
+	dialBackendWithKey(t, hs, priv, helloHandler)
+	<-done
+	if !strings.Contains(l.String(), "closing replaced connection with requests still in flight") {
+		t.Errorf("missing drain timeout log line:\n%s", l)
+	}
+	<-errc
+}
+
+func TestInFlight(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	release := make(chan struct{})
+	kh, conn := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, " world")
+	}))
+	other, _ := testBackend(t, b, hs, helloHandler)
+	testGet(t, hs, "/"+hex.EncodeToString(other[:])+"/")
+	if n := b.InFlight(); n != 0 {
+		t.Errorf("after complete request: got %d in flight, want 0", n)
+	}
+
+	// The response headers are received, and RoundTrip returned, but the body
+	// is still being streamed.
+	resp, err := hs.Client().Get(hs.URL + "/" + hex.EncodeToString(kh[:]) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := b.InFlight(); n != 1 {
+		t.Errorf("while streaming: got %d in flight, want 1", n)
+	}
+	if n := b.BackendInFlight(kh); n != 1 {
+		t.Errorf("while streaming: got %d in flight for backend, want 1", n)
+	}
+	if n := b.BackendInFlight(other); n != 0 {
+		t.Errorf("while streaming: got %d in flight for other backend, want 0", n)
+	}
+	close(release)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "hello world" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+	waitFor(t, func() bool { return b.InFlight() == 0 && b.BackendInFlight(kh) == 0 })
+
+	conn.Close()
+	waitFor(t, func() bool { return !b.IsConnected(kh) })
+	if n := b.BackendInFlight(kh); n != 0 {
+		t.Errorf("after disconnect: got %d in flight for backend, want 0", n)
+	}
+}
+
+func TestAuthorizeRequest(t *testing.T) {
+	b, hs := testBastion(t, &Config{
+		AuthorizeRequest: func(r *http.Request) error {
+			switch r.Header.Get("Authorization") {
+			case "Bearer secret":
+				return nil
+			case "":
+				return fmt.Errorf("missing token: %w", ErrUnauthorized)
+			default:
+				return errors.New("wrong token")
+			}
+		},
+	})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	for _, tt := range []struct {
+		path, token string
+		status      int
+	}{
+		{"/" + hex.EncodeToString(kh[:]) + "/", "Bearer secret", http.StatusOK},
+		{"/" + hex.EncodeToString(kh[:]) + "/", "", http.StatusUnauthorized},
+		{"/" + hex.EncodeToString(kh[:]) + "/", "Bearer wrong", http.StatusForbidden},
+		// Authorization happens before the path is parsed.
+		{"/invalid", "", http.StatusUnauthorized},
+		{"/invalid", "Bearer secret", http.StatusNotFound},
+	} {
+		req, err := http.NewRequest("GET", hs.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.token != "" {
+			req.Header.Set("Authorization", tt.token)
+		}
+		resp, err := hs.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s with %q: got status %d, want %d", tt.path, tt.token, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestDisconnectAll(t *testing.T) {
+	b, hs := testBastion(t, &Config{})
+	var dones []<-chan struct{}
+	for range 3 {
+		kh, _, done := dialBackend(t, hs, helloHandler)
+		waitFor(t, func() bool { return b.IsConnected(kh) })
+		dones = append(dones, done)
+	}
+	b.DisconnectAll()
+	if n := len(b.ConnectedBackends()); n != 0 {
+		t.Errorf("got %d connected backends, want 0", n)
+	}
+	for _, done := range dones {
+		<-done
+	}
+	testBackend(t, b, hs, helloHandler)
+}
+
+func TestSetAllowedBackends(t *testing.T) {
+	b, hs := testServer(t, context.Background(), &Config{})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh := keyHash(sha256.Sum256(priv.Public().(ed25519.PublicKey)))
+
+	_, _, done := dialBackendWithKey(t, hs, priv, helloHandler)
+	<-done
+	if n := b.AcceptedConnections(); n != 0 {
+		t.Fatalf("backend accepted before SetAllowedBackends")
+	}
+
+	allowed := map[[sha256.Size]byte]bool{kh: true}
+	b.SetAllowedBackends(allowed)
+	delete(allowed, kh) // SetAllowedBackends must make a copy.
+	_, conn, _ := dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+	conn.Close()
+	waitFor(t, func() bool { return !b.IsConnected(kh) })
+
+	b.SetAllowedBackends(nil)
+	_, _, done = dialBackendWithKey(t, hs, priv, helloHandler)
+	<-done
+	if n := b.AcceptedConnections(); n != 1 {
+		t.Errorf("got %d accepted connections, want 1", n)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	l := &testLog{t: t}
+	b, hs := testBastion(t, &Config{AccessLog: log.New(l, "", 0)})
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "hello from "+r.URL.Path)
+	}))
+	khHex := hex.EncodeToString(kh[:])
+	testGet(t, hs, "/"+khHex+"/foo")
+	testGet(t, hs, "/"+khHex+"/missing")
+	testGet(t, hs, "/invalid")
+
+	lines := strings.Split(strings.TrimSpace(l.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d access log lines, want 2:\n%s", len(lines), l)
+	}
+	if want := khHex + " GET /foo 200 15 "; !strings.HasPrefix(lines[0], want) {
+		t.Errorf("got %q, want prefix %q", lines[0], want)
+	}
+	if want := khHex + " GET /missing 404 19 "; !strings.HasPrefix(lines[1], want) {
+		t.Errorf("got %q, want prefix %q", lines[1], want)
+	}
+}
+
+func TestAccessLogger(t *testing.T) {
+	l := &testLog{t: t}
+	b, hs := testBastion(t, &Config{
+		AccessLogger: slog.New(slog.NewJSONHandler(l, nil)),
+		RequestID:    true,
+	})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/foo")
+
+	var record struct {
+		Msg        string
+		Backend    string
+		Method     string
+		Path       string
+		Status     int
+		Bytes      int64
+		Duration   int64
+		RemoteAddr string `json:"remote_addr"`
+		RequestID  string `json:"request_id"`
+	}
+	if err := json.Unmarshal([]byte(l.String()), &record); err != nil {
+		t.Fatalf("%v: %q", err, l)
+	}
+	if record.Msg != "request" || record.Backend != hex.EncodeToString(kh[:]) ||
+		record.Method != "GET" || record.Path != "/foo" || record.Status != 200 ||
+		record.Bytes != 15 || record.Duration <= 0 || record.RemoteAddr == "" ||
+		record.RequestID == "" {
+		t.Errorf("got %+v", record)
+	}
+}
+
+func TestAccessLogFields(t *testing.T) {
+	if _, err := New(&Config{AccessLogFields: []string{"method", "user_agent"}}); err == nil {
+		t.Error("unknown access log field was accepted")
+	}
+
+	l := &testLog{t: t}
+	b, hs := testBastion(t, &Config{
+		AccessLogger:          slog.New(slog.NewJSONHandler(l, nil)),
+		AccessLogFields:       []string{"client_ip", "backend", "path", "status"},
+		TrustForwardedHeaders: true,
+	})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	req, err := http.NewRequest("GET", hs.URL+"/"+hex.EncodeToString(kh[:])+"/a%22b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	resp, err := hs.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var record map[string]any
+	if err := json.Unmarshal([]byte(l.String()), &record); err != nil {
+		t.Fatalf("%v: %q", err, l)
+	}
+	want := map[string]any{
+		"client_ip": "192.0.2.1",
+		"backend":   hex.EncodeToString(kh[:]),
+		"path":      "/a%22b",
+		"status":    float64(200),
+	}
+	for k, v := range want {
+		if record[k] != v {
+			t.Errorf("%s: got %v, want %v", k, record[k], v)
+		}
+	}
+	for _, k := range []string{"method", "bytes", "duration", "remote_addr", "request_id"} {
+		if _, ok := record[k]; ok {
+			t.Errorf("unexpected field %q in %v", k, record)
+		}
+	}
+}
+
+func TestRecheckAllowedBackends(t *testing.T) {
+	b, hs := testServer(t, context.Background(), &Config{})
+	_, privA, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, privB, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := keyHash(sha256.Sum256(privA.Public().(ed25519.PublicKey)))
+	bb := keyHash(sha256.Sum256(privB.Public().(ed25519.PublicKey)))
+	b.SetAllowedBackends(map[[sha256.Size]byte]bool{a: true, bb: true})
+	_, _, doneA := dialBackendWithKey(t, hs, privA, helloHandler)
+	_, _, doneB := dialBackendWithKey(t, hs, privB, helloHandler)
+	waitFor(t, func() bool { return b.IsConnected(a) && b.IsConnected(bb) })
+
+	b.SetAllowedBackends(map[[sha256.Size]byte]bool{a: true})
+	<-doneB
+	if b.IsConnected(bb) {
+		t.Error("revoked backend is still connected")
+	}
+	select {
+	case <-doneA:
+		t.Error("allowed backend was disconnected")
+	default:
+	}
+}
+
+func TestRecheckAllowedBackendCallback(t *testing.T) {
+	var revoked atomic.Bool
+	b, hs := testBastion(t, &Config{
+		AllowedBackend: func([sha256.Size]byte) bool { return !revoked.Load() },
+	})
+	kh, _, done := dialBackend(t, hs, helloHandler)
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+	b.RecheckAllowedBackends()
+	if !b.IsConnected(kh) {
+		t.Fatal("allowed backend was disconnected")
+	}
+	revoked.Store(true)
+	b.RecheckAllowedBackends()
+	<-done
+}
+
+func TestAcceptTimeout(t *testing.T) {
+	l := &testLog{t: t}
+	_, hs := testBastion(t, &Config{AcceptTimeout: 100 * time.Millisecond, Log: log.New(l, "", 0)})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := backendCertificate(t, priv.Public().(ed25519.PublicKey), priv)
+	conn, err := tlsDialBackend(hs, cert, priv, "bastion/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Complete the TLS handshake, but never speak HTTP/2.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("connection was not closed by the bastion: %v", err)
+	}
+	if !strings.Contains(l.String(), "did not respond to PING within 100ms") {
+		t.Errorf("missing timeout log line:\n%s", l)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	l := &testLog{t: t}
+	b, hs := testBastion(t, &Config{
+		RequestID:       true,
+		RequestIDHeader: "x-trace-id",
+		AccessLog:       log.New(l, "", 0),
+	})
+	kh, _ := testBackend(t, b, hs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Trace-Id"))
+	}))
+	url := hs.URL + "/" + hex.EncodeToString(kh[:]) + "/"
+
+	_, generated := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/")
+	if len(generated) != 32 {
+		t.Errorf("got generated request ID %q", generated)
+	}
+	_, other := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/")
+	if other == generated {
+		t.Errorf("request ID %q was reused", other)
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Trace-Id", "inbound-id")
+	resp, err := hs.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "inbound-id" {
+		t.Errorf("got request ID %q, want inbound-id", body)
+	}
+
+	for _, id := range []string{generated, other, "inbound-id"} {
+		if !strings.Contains(l.String(), " "+id+"\n") {
+			t.Errorf("request ID %q missing from access log:\n%s", id, l)
+		}
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	b, hs := testBastion(t, &Config{PathPrefix: "/bastion/"})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	khHex := hex.EncodeToString(kh[:])
+	client := hs.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	for _, tt := range []struct {
+		path     string
+		status   int
+		location string
+	}{
+		{"/bastion/" + khHex + "/foo", http.StatusOK, ""},
+		{"/bastion/" + khHex, http.StatusPermanentRedirect, "/bastion/" + khHex + "/"},
+		{"/" + khHex + "/foo", http.StatusNotFound, ""},
+		{"/bastionx/" + khHex + "/foo", http.StatusNotFound, ""},
+		{"/bastion", http.StatusNotFound, ""},
+	} {
+		resp, err := client.Get(hs.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+		if loc := resp.Header.Get("Location"); loc != tt.location {
+			t.Errorf("%s: got Location %q, want %q", tt.path, loc, tt.location)
+		}
+	}
+	if _, body := testGet(t, hs, "/bastion/"+khHex+"/foo"); body != "hello from /foo" {
+		t.Errorf("got body %q", body)
+	}
+}
+
+type testCollector struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (c *testCollector) record(format string, args ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, fmt.Sprintf(format, args...))
+}
+
+func (c *testCollector) BackendConnected(kh [sha256.Size]byte, replaced bool) {
+	c.record("connected %x %v", kh[:4], replaced)
+}
+
+func (c *testCollector) BackendDisconnected(kh [sha256.Size]byte) {
+	c.record("disconnected %x", kh[:4])
+}
+
+func (c *testCollector) RequestCompleted(kh [sha256.Size]byte, status int, reason string, bytesIn, bytesOut int64) {
+	if reason != "" {
+		c.record("request %x %d %d %d %s", kh[:4], status, bytesIn, bytesOut, reason)
+		return
+	}
+	c.record("request %x %d %d %d", kh[:4], status, bytesIn, bytesOut)
+}
+
+func (c *testCollector) has(event string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Contains(c.events, event)
+}
+
+func (c *testCollector) hasPrefix(prefix string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.ContainsFunc(c.events, func(e string) bool {
+		return strings.HasPrefix(e, prefix)
+	})
+}
+
+func (c *testCollector) hasSuffix(suffix string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.ContainsFunc(c.events, func(e string) bool {
+		return strings.HasSuffix(e, suffix)
+	})
+}
+
+func TestCollector(t *testing.T) {
+	c := &testCollector{}
+	b, hs := testBastion(t, &Config{Collector: c})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, conn, _ := dialBackendWithKey(t, hs, priv, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "got %s", body)
+	}))
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+	if !c.has(fmt.Sprintf("connected %x false", kh[:4])) {
+		t.Errorf("missing connected event: %q", c.events)
+	}
+
+	resp, err := hs.Client().Post(hs.URL+"/"+hex.EncodeToString(kh[:])+"/", "text/plain", strings.NewReader("12345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if !c.has(fmt.Sprintf("request %x 200 5 9", kh[:4])) {
+		t.Errorf("missing request event: %q", c.events)
+	}
+
+	_, _, done := dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return c.has(fmt.Sprintf("connected %x true", kh[:4])) })
+	conn.Close()
+	waitFor(t, func() bool { return c.has(fmt.Sprintf("disconnected %x", kh[:4])) })
+
+	b.ForceDisconnect(kh)
+	<-done
+	testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/")
+	if !c.has(fmt.Sprintf("request %x 503 0 20 unavailable", kh[:4])) {
+		t.Errorf("missing unavailable request event: %q", c.events)
+	}
+}
+
+func TestCollectorRejections(t *testing.T) {
+	c := &testCollector{}
+	b, hs := testBastion(t, &Config{
+		Collector:           c,
+		MaxRequestBodyBytes: 4,
+		AllowRequest: func(kh [sha256.Size]byte, method, path string) bool {
+			return path != "/denied"
+		},
+	})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	base := hs.URL + "/" + hex.EncodeToString(kh[:])
+	client := hs.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	do := func(method, url, body string) {
+		t.Helper()
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	do("GET", base+"/denied", "")
+	do("GET", base, "")
+	do("POST", base+"/", "too long")
+	b.Pause()
+	do("GET", base+"/", "")
+	b.Resume()
+	for _, tt := range []struct {
+		status int
+		reason string
+	}{
+		{403, "request_not_allowed"},
+		{308, "redirect"},
+		{413, "body_too_large"},
+		{503, "paused"},
+	} {
+		prefix := fmt.Sprintf("request %x %d 0 ", kh[:4], tt.status)
+		if !c.hasPrefix(prefix) || !c.hasSuffix(" "+tt.reason) {
+			t.Errorf("missing %d %s request event: %q", tt.status, tt.reason, c.events)
+		}
+	}
+
+	c2 := &testCollector{}
+	_, hs2 := testBastion(t, &Config{
+		Collector: c2,
+		NoBackendsHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "no backends", http.StatusServiceUnavailable)
+		}),
+	})
+	testGet(t, hs2, "/"+hex.EncodeToString(kh[:])+"/")
+	if !c2.has(fmt.Sprintf("request %x 503 0 12 no_backends", kh[:4])) {
+		t.Errorf("missing NoBackendsHandler request event: %q", c2.events)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	ready := func(b *Bastion, want int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		b.ReadyHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+		if rec.Code != want {
+			t.Errorf("got status %d, want %d: %s", rec.Code, want, rec.Body)
+		}
+	}
+
+	// By default, the bastion is always ready.
+	b, _ := testBastion(t, &Config{})
+	ready(b, http.StatusOK)
+
+	b, hs := testBastion(t, &Config{MinBackendsForReady: 2, MaxConnectionsPerBackend: 2})
+	ready(b, http.StatusServiceUnavailable)
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.AcceptedConnections() == 1 })
+	ready(b, http.StatusServiceUnavailable)
+
+	// A replica connection of the same backend doesn't count twice.
+	dialBackendWithKey(t, hs, priv, helloHandler)
+	waitFor(t, func() bool { return b.pool.connected() == 2 })
+	ready(b, http.StatusServiceUnavailable)
+
+	_, conn := testBackend(t, b, hs, helloHandler)
+	ready(b, http.StatusOK)
+
+	// A paused bastion is not ready, even with enough backends connected.
+	b.Pause()
+	ready(b, http.StatusServiceUnavailable)
+	if b.Ready() {
+		t.Error("Ready returned true while paused")
+	}
+	b.Resume()
+	ready(b, http.StatusOK)
+	if !b.Ready() {
+		t.Error("Ready returned false after Resume")
+	}
+
+	conn.Close()
+	waitFor(t, func() bool { return b.pool.connectedBackends() == 1 })
+	ready(b, http.StatusServiceUnavailable)
+}
+
+func TestMaxConnectionsPerBackend(t *testing.T) {
+	b, hs := testBastion(t, &Config{MaxConnectionsPerBackend: 2, MinBackendsForReady: 2})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entered, unblock := make(chan struct{}), make(chan struct{})
+	replica := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				entered <- struct{}{}
+				<-unblock
+			}
+			io.WriteString(w, name)
+		})
+	}
+	kh, _, doneA := dialBackendWithKey(t, hs, priv, replica("A"))
+	waitFor(t, func() bool { return b.AcceptedConnections() == 1 })
+	_, _, doneB := dialBackendWithKey(t, hs, priv, replica("B"))
+	waitFor(t, func() bool { return b.AcceptedConnections() == 2 })
+	if n := b.pool.connected(); n != 2 {
+		t.Fatalf("got %d live connections, want 2", n)
+	}
+	if n := b.pool.connectedBackends(); n != 1 {
+		t.Errorf("got %d connected backends, want 1", n)
+	}
+	if b.Ready() {
+		t.Error("two connections of the same backend made the bastion ready")
+	}
+	path := "/" + hex.EncodeToString(kh[:]) + "/"
+
+	// B is the newest connection, so it gets requests while both are idle,
+	// and A gets them while B is busy.
+	slow := make(chan string)
+	go func() {
+		resp, err := hs.Client().Get(hs.URL + path + "slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		slow <- string(body)
+	}()
+	<-entered
+	if _, body := testGet(t, hs, path); body != "A" {
+		t.Errorf("got %q while B is busy, want A", body)
+	}
+	close(unblock)
+	if body := <-slow; body != "B" {
+		t.Errorf("got %q for the first request, want B", body)
+	}
+
+	// A third connection evicts the oldest one, A.
+	_, connC, _ := dialBackendWithKey(t, hs, priv, replica("C"))
+	<-doneA
+	if n := b.pool.connected(); n != 2 {
+		t.Errorf("got %d live connections, want 2", n)
+	}
+	if _, body := testGet(t, hs, path); body != "C" {
+		t.Errorf("got %q, want C", body)
+	}
+
+	// Closing the newest connection falls back to the replica.
+	connC.Close()
+	waitFor(t, func() bool { return b.pool.connected() == 1 })
+	if _, body := testGet(t, hs, path); body != "B" {
+		t.Errorf("got %q, want B", body)
+	}
+
+	if !b.ForceDisconnect(kh) {
+		t.Fatal("ForceDisconnect found no connection")
+	}
+	<-doneB
+}
+
+func TestRejectDelay(t *testing.T) {
+	// rejected dials a backend that is not allowed, and returns a channel
+	// that receives when its handshake fails.
+	rejected := func(hs *httptest.Server) <-chan error {
+		t.Helper()
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := backendCertificate(t, priv.Public().(ed25519.PublicKey), priv)
+		failed := make(chan error, 1)
+		go func() {
+			conn, err := tlsDialBackend(hs, cert, priv, "bastion/0")
+			if err != nil {
+				failed <- err
+				return
+			}
+			defer conn.Close()
+			// In TLS 1.3, the server verifies the client certificate after
+			// the client completed the handshake, so the failure is only
+			// visible on the first read.
+			_, err = conn.Read(make([]byte, 1))
+			failed <- err
+		}()
+		return failed
+	}
+	notAllowed := func([sha256.Size]byte) bool { return false }
+
+	b, hs := testBastion(t, &Config{AllowedBackend: notAllowed, RejectDelay: 200 * time.Millisecond})
+	start := time.Now()
+	if err := <-rejected(hs); err == nil {
+		t.Fatal("backend that is not allowed was accepted")
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("rejected after %v, want at least 200ms", d)
+	}
+
+	b, hs = testBastion(t, &Config{AllowedBackend: notAllowed, RejectDelay: time.Hour})
+	failed := rejected(hs)
+	waitFor(t, func() bool { return b.pool.metrics.rejected.Load() == 1 })
+	select {
+	case <-failed:
+		t.Fatal("rejected before the delay")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := b.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Error("backend that is not allowed was accepted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rejected handshake was still held after Shutdown")
+	}
+}
+
+// pingClientConn is a fakeClientConn that records the time left before the
+// deadline of the context of its first Ping.
+type pingClientConn struct {
+	*fakeClientConn
+	timeout chan time.Duration
+}
+
+func (p pingClientConn) Ping(ctx context.Context) error {
+	deadline, _ := ctx.Deadline()
+	select {
+	case p.timeout <- time.Until(deadline):
+	default:
+	}
+	return nil
+}
+
+func TestPingSettings(t *testing.T) {
+	for _, tt := range []struct {
+		name                        string
+		c                           Config
+		interval, timeout, accepted time.Duration
+	}{
+		{"defaults", Config{}, 15 * time.Second, 15 * time.Second, 5 * time.Second},
+		{"ping", Config{PingInterval: time.Minute, PingTimeout: 3 * time.Second},
+			time.Minute, 3 * time.Second, 3 * time.Second},
+		{"accept", Config{PingTimeout: 3 * time.Second, AcceptTimeout: 10 * time.Second},
+			15 * time.Second, 3 * time.Second, 10 * time.Second},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			timeouts := make(chan time.Duration, 1)
+			c := tt.c
+			c.newClientConn = func(nc net.Conn) (clientConn, error) {
+				return pingClientConn{&fakeClientConn{nc: nc}, timeouts}, nil
+			}
+			b, hs := testBastion(t, &c)
+			tr := b.pool.transport()
+			if tr.ReadIdleTimeout != tt.interval {
+				t.Errorf("ReadIdleTimeout is %v, want %v", tr.ReadIdleTimeout, tt.interval)
+			}
+			if tr.PingTimeout != tt.timeout {
+				t.Errorf("PingTimeout is %v, want %v", tr.PingTimeout, tt.timeout)
+			}
+
+			kh, _, _ := dialBackend(t, hs, helloHandler)
+			if d := <-timeouts; d > tt.accepted || d < tt.accepted-time.Second {
+				t.Errorf("handshake PING timeout is %v, want %v", d, tt.accepted)
+			}
+			waitFor(t, func() bool { return b.IsConnected(kh) })
+			b.ForceDisconnect(kh)
+		})
+	}
+}
+
+// slowPingClientConn is a fakeClientConn whose PINGs take delay nanoseconds.
+type slowPingClientConn struct {
+	*fakeClientConn
+	delay *atomic.Int64
+}
+
+func (s slowPingClientConn) Ping(ctx context.Context) error {
+	time.Sleep(time.Duration(s.delay.Load()))
+	return nil
+}
+
+func TestPingRTT(t *testing.T) {
+	delay := new(atomic.Int64)
+	b, hs := testBastion(t, &Config{
+		PingInterval: 10 * time.Millisecond,
+		newClientConn: func(nc net.Conn) (clientConn, error) {
+			return slowPingClientConn{&fakeClientConn{nc: nc}, delay}, nil
+		},
+	})
+	kh, _, _ := dialBackend(t, hs, helloHandler)
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+
+	status := func() (ping, handshake time.Duration) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		b.StatusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		var status struct {
+			Backends []struct {
+				PingRTT          string `json:"ping_rtt"`
+				HandshakePingRTT string `json:"handshake_ping_rtt"`
+			} `json:"backends"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if len(status.Backends) != 1 {
+			t.Fatalf("got %d backends, want 1", len(status.Backends))
+		}
+		ping, err := time.ParseDuration(status.Backends[0].PingRTT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handshake, err = time.ParseDuration(status.Backends[0].HandshakePingRTT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ping, handshake
+	}
+
+	// The periodic PINGs update ping_rtt, but not handshake_ping_rtt.
+	delay.Store(int64(30 * time.Millisecond))
+	waitFor(t, func() bool { ping, _ := status(); return ping >= 30*time.Millisecond })
+	if _, handshake := status(); handshake >= 30*time.Millisecond {
+		t.Errorf("handshake ping RTT changed to %v", handshake)
+	}
+	delay.Store(0)
+	waitFor(t, func() bool { ping, _ := status(); return ping < 30*time.Millisecond })
+	b.ForceDisconnect(kh)
+}
+
+func TestPingTimeoutUnresponsive(t *testing.T) {
+	b, hs := testBastion(t, &Config{PingTimeout: 200 * time.Millisecond})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := backendCertificate(t, priv.Public().(ed25519.PublicKey), priv)
+	conn, err := tlsDialBackend(hs, cert, priv, "bastion/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Read the bastion's frames without ever answering its PING, until the
+	// bastion gives up on the connection.
+	start := time.Now()
+	io.Copy(io.Discard, conn)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("unresponsive backend dropped after %v, want about 200ms", d)
+	}
+	if n := b.AcceptedConnections(); n != 0 {
+		t.Errorf("got %d accepted connections, want 0", n)
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	var allowed, unknown keyHash
+	rand.Read(allowed[:])
+	rand.Read(unknown[:])
+	_, hs := testServer(t, context.Background(), &Config{
+		ErrorFormat:    ErrorFormatProblemJSON,
+		AllowedBackend: func(kh [sha256.Size]byte) bool { return kh == allowed },
+	})
+
+	resp, body := testGet(t, hs, "/"+hex.EncodeToString(unknown[:])+"/")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown backend: got status %d, want 404", resp.StatusCode)
+	}
+	if !strings.Contains(body, `"unknown backend"`) {
+		t.Errorf("unknown backend: got body %q", body)
+	}
+
+	resp, body = testGet(t, hs, "/"+hex.EncodeToString(allowed[:])+"/")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("offline backend: got status %d, want 503", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("offline backend: missing Retry-After")
+	}
+	if !strings.Contains(body, `"backend unavailable"`) {
+		t.Errorf("offline backend: got body %q", body)
+	}
+}
+
+func TestRequestRateLimit(t *testing.T) {
+	b, hs := testBastion(t, &Config{RequestsPerSecondPerBackend: 0.5, RequestBurstPerBackend: 2})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	path := "/" + hex.EncodeToString(kh[:]) + "/"
+	for i := range 2 {
+		if resp, _ := testGet(t, hs, path); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want 200", i, resp.StatusCode)
+		}
+	}
+	resp, _ := testGet(t, hs, path)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want 429", resp.StatusCode)
+	}
+	if ra := resp.Header.Get("Retry-After"); ra != "2" {
+		t.Errorf("got Retry-After %q, want 2", ra)
+	}
+
+	var tb tokenBucket
+	now := time.Now()
+	if ok, _ := tb.take(now, 0.5, 1); !ok {
+		t.Fatal("first token not available")
+	}
+	if ok, wait := tb.take(now.Add(time.Second), 0.5, 1); ok || wait != time.Second {
+		t.Errorf("got %v, %v after 1s, want false, 1s", ok, wait)
+	}
+	if ok, _ := tb.take(now.Add(2*time.Second), 0.5, 1); !ok {
+		t.Error("token not refilled after 2s")
+	}
+}
+
+func TestRequestRateLimitPolicy(t *testing.T) {
+	b, hs := testServer(t, context.Background(), &Config{
+		RequestsPerSecondPerBackend: 0.5,
+		AdmitBackend: func([sha256.Size]byte) (BackendPolicy, bool) {
+			return BackendPolicy{RequestsPerSecond: -1}, true
+		},
+	})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	for i := range 5 {
+		if resp, _ := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want 200", i, resp.StatusCode)
+		}
+	}
+}
+
+func TestAuthorizeBackend(t *testing.T) {
+	_, denied, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deniedHash := keyHash(sha256.Sum256(denied.Public().(ed25519.PublicKey)))
+	var mu sync.Mutex
+	var infos []BackendInfo
+	l := &testLog{t: t}
+	b, hs := testBastion(t, &Config{
+		Log: log.New(l, "", 0),
+		AuthorizeBackend: func(ctx context.Context, info BackendInfo) error {
+			if ctx == nil {
+				t.Error("nil context")
+			}
+			mu.Lock()
+			infos = append(infos, info)
+			mu.Unlock()
+			if info.KeyHash == deniedHash {
+				return errors.New("key is suspended")
+			}
+			return nil
+		},
+	})
+
+	_, _, done := dialBackendWithKey(t, hs, denied, helloHandler)
+	<-done
+	if n := b.AcceptedConnections(); n != 0 {
+		t.Errorf("got %d accepted connections, want 0", n)
+	}
+	if !strings.Contains(l.String(), "not authorized: key is suspended") {
+		t.Errorf("rejection not logged:\n%s", l)
+	}
+
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	if _, body := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/"); body != "hello from /" {
+		t.Errorf("got %q", body)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(infos) != 2 {
+		t.Fatalf("AuthorizeBackend called %d times, want 2", len(infos))
+	}
+	if info := infos[1]; info.KeyHash != kh || info.RemoteAddr == nil ||
+		len(info.ConnectionState.PeerCertificates) != 1 {
+		t.Errorf("got %+v", info)
+	}
+}
+
+func TestAllowRequest(t *testing.T) {
+	var allowed keyHash
+	b, hs := testBastion(t, &Config{
+		AllowRequest: func(kh [sha256.Size]byte, method, path string) bool {
+			return kh != allowed || method == http.MethodGet && path == "/add-checkpoint"
+		},
+	})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	allowed = kh
+	base := hs.URL + "/" + hex.EncodeToString(kh[:])
+
+	if resp, body := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/add-checkpoint"); resp.StatusCode != http.StatusOK ||
+		body != "hello from /add-checkpoint" {
+		t.Errorf("allowed request: got %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/other"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("other path: got status %d, want 403", resp.StatusCode)
+	}
+	resp, err := hs.Client().Post(base+"/add-checkpoint", "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST: got status %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	bp := &bufferPool{}
+	b := bp.Get()
+	if len(b) != 32*1024 {
+		t.Fatalf("got buffer of %d bytes, want 32KiB", len(b))
+	}
+	bp.Put(b[:10])
+	if b := bp.Get(); len(b) != 32*1024 {
+		t.Errorf("got reused buffer of %d bytes, want 32KiB", len(b))
+	}
+	bp.Put(make([]byte, 10)) // dropped
+}
+
+func TestBackendForHost(t *testing.T) {
+	var vanity keyHash
+	b, hs := testBastion(t, &Config{
+		BackendForHost: func(host string) ([sha256.Size]byte, bool) {
+			return vanity, host == "witness.example.org"
+		},
+	})
+	kh, _ := testBackend(t, b, hs, helloHandler)
+	vanity = kh
+
+	for _, host := range []string{"witness.example.org", "Witness.Example.org.:443"} {
+		req, err := http.NewRequest("GET", hs.URL+"/add-checkpoint", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := hs.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello from /add-checkpoint" {
+			t.Errorf("%s: got %d %q", host, resp.StatusCode, body)
+		}
+	}
+
+	// Other hosts are still routed by path.
+	if _, body := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/foo"); body != "hello from /foo" {
+		t.Errorf("path routing: got %q", body)
+	}
+	if resp, _ := testGet(t, hs, "/add-checkpoint"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unmapped host: got status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestMaxConnectionAge(t *testing.T) {
+	l := &testLog{t: t}
+	b, hs := testBastion(t, &Config{MaxConnectionAge: 100 * time.Millisecond, Log: log.New(l, "", 0)})
+	kh, _, done := dialBackend(t, hs, helloHandler)
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+	if _, body := testGet(t, hs, "/"+hex.EncodeToString(kh[:])+"/"); body != "hello from /" {
+		t.Errorf("got %q", body)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not shut down")
+	}
+	if b.IsConnected(kh) {
+		t.Error("backend still connected")
+	}
+	if !strings.Contains(l.String(), "shutting down backend connection older than 100ms") {
+		t.Errorf("missing log line:\n%s", l)
+	}
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Bastion-Backend", "spoofed")
+		fmt.Fprintf(w, "%q %q %q", r.Header.Get("X-Bastion-Client-Key-Hash"),
+			r.Header.Get("X-Bastion-Client-TLS-Version"), r.Header.Get("X-Bastion-Client-Protocol"))
+	})
+	get := func(t *testing.T, hs *httptest.Server, kh keyHash) (*http.Response, string) {
+		req, err := http.NewRequest("GET", hs.URL+"/"+hex.EncodeToString(kh[:])+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Bastion-Client-Key-Hash", "spoofed")
+		resp, err := hs.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	t.Run("Enabled", func(t *testing.T) {
+		b, hs := testBastion(t, &Config{})
+		kh, _ := testBackend(t, b, hs, echo)
+		resp, body := get(t, hs, kh)
+		if want := `"" "TLS 1.3" "HTTP/1.1"`; body != want {
+			t.Errorf("backend got %s, want %s", body, want)
+		}
+		if got := resp.Header.Values("X-Bastion-Backend"); len(got) != 1 || got[0] != hex.EncodeToString(kh[:]) {
+			t.Errorf("got X-Bastion-Backend %q", got)
+		}
+
+		// Errors generated by the bastion are attributed too.
+		b.ForceDisconnect(kh)
+		waitFor(t, func() bool { return !b.IsConnected(kh) })
+		resp, _ = get(t, hs, kh)
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("got status %d, want 503", resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Bastion-Backend"); got != hex.EncodeToString(kh[:]) {
+			t.Errorf("got X-Bastion-Backend %q on error", got)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		b, hs := testBastion(t, &Config{DisableIdentityHeaders: true})
+		kh, _ := testBackend(t, b, hs, echo)
+		resp, body := get(t, hs, kh)
+		if want := `"" "" ""`; body != want {
+			t.Errorf("backend got %s, want %s", body, want)
+		}
+		if got := resp.Header.Get("X-Bastion-Backend"); got != "spoofed" {
+			t.Errorf("got X-Bastion-Backend %q", got)
+		}
+	})
+}
@@ -0,0 +1,197 @@
+// Package bastionclient connects backends to a bastion, as implemented by
+// package filippo.io/litetlog/bastion, and serves HTTP requests over the
+// reversed connection.
+//
+// A backend is identified by the SHA-256 hash of its Ed25519 public key, which
+// it presents to the bastion in a self-signed TLS client certificate.
+package bastionclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"time"
+
+	"filippo.io/litetlog/bastion"
+	"golang.org/x/net/http2"
+)
+
+// Config provides parameters for connecting to a bastion.
+type Config struct {
+	// Key is the Ed25519 key that identifies the backend. Its Public method
+	// must return an [ed25519.PublicKey].
+	Key crypto.Signer
+
+	// RootCAs, if not nil, are the roots used to verify the certificate of
+	// the bastion. If nil, the system roots are used.
+	RootCAs *x509.CertPool
+
+	// Logger is used to log connection events. If nil, [slog.Default] is used.
+	Logger *slog.Logger
+
+	// DialTimeout is how long Dial waits for the connection and handshake to
+	// complete. If zero, 5s is used.
+	DialTimeout time.Duration
+
+	// Protocols are the bastion protocol ALPN identifiers offered to the
+	// bastion, in order of preference. If empty, only [bastion.DefaultProtocol]
+	// is offered. The negotiated protocol is available from the connection
+	// returned by Dial, but ServeConn and Serve only implement HTTP/2, which
+	// is the framing of all current bastion protocols.
+	Protocols []string
+
+	// MaxBackoff is the longest Serve waits between attempts to connect to
+	// the bastions. If zero, one minute is used.
+	MaxBackoff time.Duration
+}
+
+// Dial connects to the bastion at addr, authenticating as the backend
+// identified by c.Key.
+//
+// Note that with TLS 1.3 the bastion might reject the backend only after the
+// handshake completes, in which case the rejection surfaces as an error on the
+// first read from the connection.
+func Dial(ctx context.Context, addr string, c *Config) (*tls.Conn, error) {
+	if _, ok := c.Key.Public().(ed25519.PublicKey); !ok {
+		return nil, errors.New("bastionclient: key is not Ed25519")
+	}
+	cert, err := selfSignedCertificate(c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("bastionclient: generating self-signed certificate: %w", err)
+	}
+	protocols := c.Protocols
+	if len(protocols) == 0 {
+		protocols = []string{bastion.DefaultProtocol}
+	}
+	timeout := c.DialTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := (&tls.Dialer{
+		Config: &tls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{cert},
+				PrivateKey:  c.Key,
+			}},
+			MinVersion: tls.VersionTLS13,
+			MaxVersion: tls.VersionTLS13,
+			NextProtos: protocols,
+			RootCAs:    c.RootCAs,
+		},
+	}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("bastionclient: connecting to bastion: %w", err)
+	}
+	tlsConn := conn.(*tls.Conn)
+	if p := tlsConn.ConnectionState().NegotiatedProtocol; !slices.Contains(protocols, p) {
+		conn.Close()
+		return nil, fmt.Errorf("bastionclient: %s did not negotiate the bastion protocol (got %q)", addr, p)
+	}
+	return tlsConn, nil
+}
+
+// ServeConn serves HTTP/2 requests from the bastion over conn with
+// srv.Handler, until the connection is closed or ctx is canceled.
+//
+// srv is used as the base configuration for the HTTP/2 server, but it doesn't
+// need to be listening.
+func ServeConn(ctx context.Context, conn *tls.Conn, srv *http.Server) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	(&http2.Server{
+		CountError: func(errType string) {
+			if http2.VerboseLogs {
+				slog.Debug("HTTP/2 server error", "type", errType)
+			}
+		},
+	}).ServeConn(conn, &http2.ServeConnOpts{
+		Context:    ctx,
+		BaseConfig: srv,
+		Handler:    srv.Handler,
+	})
+}
+
+// Serve connects to the first reachable bastion in addrs and serves requests
+// from it with srv.Handler, like [ServeConn].
+//
+// When the connection is interrupted, Serve tries the bastions again in order.
+// If none is reachable, or if the connection didn't last, it waits with
+// exponential backoff, up to c.MaxBackoff, before trying again. Serve returns
+// ctx's error once ctx is canceled.
+func Serve(ctx context.Context, addrs []string, c *Config, srv *http.Server) error {
+	if len(addrs) == 0 {
+		return errors.New("bastionclient: no bastion addresses")
+	}
+	log := c.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	maxBackoff := c.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = 1 * time.Minute
+	}
+	backoff := time.Second
+	for {
+		if serveFirst(ctx, addrs, c, srv, log) > backoff {
+			// The connection was healthy for a while, reconnect right away.
+			backoff = time.Second
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Info("waiting before reconnecting to bastion", "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// serveFirst serves requests from the first reachable bastion in addrs, and
+// returns how long the connection lasted, or zero if none was reachable.
+func serveFirst(ctx context.Context, addrs []string, c *Config, srv *http.Server, log *slog.Logger) time.Duration {
+	for _, addr := range addrs {
+		log.Info("connecting to bastion", "bastion", addr)
+		conn, err := Dial(ctx, addr, c)
+		if ctx.Err() != nil {
+			return 0
+		}
+		if err != nil {
+			log.Info("connecting to bastion failed", "bastion", addr, "err", err)
+			continue
+		}
+		log.Info("connected to bastion", "bastion", addr)
+		start := time.Now()
+		ServeConn(ctx, conn, srv)
+		log.Info("connection to bastion interrupted", "bastion", addr)
+		return time.Since(start)
+	}
+	return 0
+}
+
+// selfSignedCertificate returns a TLS client certificate for key, signed by
+// key itself, as required by the bastion.
+func selfSignedCertificate(key crypto.Signer) ([]byte, error) {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	return x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+}
@@ -0,0 +1,149 @@
+package bastionclient_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"filippo.io/litetlog/bastion"
+	"filippo.io/litetlog/bastion/bastionclient"
+)
+
+func TestServe(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh := sha256.Sum256(priv.Public().(ed25519.PublicKey))
+
+	b, hs := newBastion(t, &bastion.Config{
+		AllowedBackend: func(keyHash [sha256.Size]byte) bool { return keyHash == kh },
+	})
+
+	// An address that refuses connections, which Serve should skip.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := l.Addr().String()
+	l.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(hs.Certificate())
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- bastionclient.Serve(ctx, []string{unreachable, hs.Listener.Addr().String()},
+			&bastionclient.Config{Key: priv, RootCAs: roots},
+			&http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "hello from "+r.URL.Path)
+			})})
+	}()
+
+	waitFor(t, func() bool { return b.IsConnected(kh) })
+	resp, err := hs.Client().Get(hs.URL + "/" + hex.EncodeToString(kh[:]) + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello from /foo" {
+		t.Errorf("got %q", body)
+	}
+
+	// Serve reconnects after the connection is interrupted.
+	b.ForceDisconnect(kh)
+	waitFor(t, func() bool { return b.AcceptedConnections() == 2 && b.IsConnected(kh) })
+
+	cancel()
+	if err := <-served; !errors.Is(err, context.Canceled) {
+		t.Errorf("Serve returned %v, want context.Canceled", err)
+	}
+}
+
+func TestDialProtocols(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hs := newBastion(t, &bastion.Config{
+		AllowedBackend: func([sha256.Size]byte) bool { return true },
+		Protocols:      []string{bastion.DefaultProtocol},
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(hs.Certificate())
+	addr := hs.Listener.Addr().String()
+
+	conn, err := bastionclient.Dial(context.Background(), addr, &bastionclient.Config{
+		Key: priv, RootCAs: roots, Protocols: []string{"bastion/1", bastion.DefaultProtocol},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client falls back to the protocol the bastion implements.
+	if p := conn.ConnectionState().NegotiatedProtocol; p != bastion.DefaultProtocol {
+		t.Errorf("negotiated %q, want %s", p, bastion.DefaultProtocol)
+	}
+	conn.Close()
+
+	if _, err := bastionclient.Dial(context.Background(), addr, &bastionclient.Config{
+		Key: priv, RootCAs: roots, Protocols: []string{"bastion/2"},
+	}); err == nil {
+		t.Error("Dial succeeded with an unsupported protocol")
+	}
+}
+
+// newBastion starts a bastion on a loopback address with config c.
+func newBastion(t *testing.T, c *bastion.Config) (*bastion.Bastion, *httptest.Server) {
+	t.Helper()
+	hs := httptest.NewUnstartedServer(nil)
+	c.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &hs.TLS.Certificates[0], nil
+	}
+	b, err := bastion.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.Config.Handler = b
+	if err := b.ConfigureServer(hs.Config); err != nil {
+		t.Fatal(err)
+	}
+	hs.TLS = hs.Config.TLSConfig
+	hs.StartTLS()
+	t.Cleanup(hs.Close)
+	return b, hs
+}
+
+func TestDialNotEd25519(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bastionclient.Dial(context.Background(), "127.0.0.1:1", &bastionclient.Config{Key: key}); err == nil {
+		t.Error("Dial accepted an ECDSA key")
+	}
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+	for range 500 {
+		if f() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
@@ -0,0 +1,131 @@
+// Package bastiontest provides utilities for end-to-end testing of bastion
+// backends.
+package bastiontest
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"filippo.io/litetlog/bastion"
+	"filippo.io/litetlog/bastion/bastionclient"
+)
+
+// A Server is a bastion listening on a loopback address, with a single backend
+// connected to it.
+type Server struct {
+	// URL is the base URL of the backend through the bastion, of the form
+	// "https://127.0.0.1:port/<hex key hash>/".
+	URL string
+
+	// KeyHash is the hash of the backend's Ed25519 public key.
+	KeyHash [sha256.Size]byte
+
+	// Bastion is the bastion the backend is connected to.
+	Bastion *bastion.Bastion
+
+	hs *httptest.Server
+}
+
+// NewServer starts a bastion with config c on a loopback address, and connects
+// to it a backend serving h, authenticated with a newly generated key.
+//
+// c may be nil. GetCertificate and AllowedBackend are set if nil, and Log
+// defaults to logging through t.
+//
+// NewServer returns after the bastion accepted the backend connection. The
+// bastion and the backend are shut down with t.Cleanup.
+func NewServer(t testing.TB, c *bastion.Config, h http.Handler) *Server {
+	t.Helper()
+	if c == nil {
+		c = &bastion.Config{}
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh := sha256.Sum256(pub)
+
+	hs := httptest.NewUnstartedServer(nil)
+	if c.GetCertificate == nil {
+		c.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &hs.TLS.Certificates[0], nil
+		}
+	}
+	if c.AllowedBackend == nil && c.AdmitBackend == nil {
+		c.AllowedBackend = func(keyHash [sha256.Size]byte) bool {
+			return keyHash == kh
+		}
+	}
+	if c.Log == nil {
+		c.Log = log.New(testWriter{t}, "", 0)
+	}
+	b, err := bastion.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.Config.Handler = b
+	if err := b.ConfigureServer(hs.Config); err != nil {
+		t.Fatal(err)
+	}
+	hs.TLS = hs.Config.TLSConfig
+	hs.StartTLS()
+	t.Cleanup(hs.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(hs.Certificate())
+	conn, err := bastionclient.Dial(context.Background(), hs.Listener.Addr().String(),
+		&bastionclient.Config{Key: priv, RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bastionclient.ServeConn(context.Background(), conn, &http.Server{Handler: h})
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+
+	for !b.IsConnected(kh) {
+		select {
+		case <-done:
+			t.Fatal("bastiontest: backend connection was rejected")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	return &Server{
+		URL:     hs.URL + "/" + hex.EncodeToString(kh[:]) + "/",
+		KeyHash: kh,
+		Bastion: b,
+		hs:      hs,
+	}
+}
+
+// Client returns an HTTP client configured to trust the bastion's certificate.
+func (s *Server) Client() *http.Client {
+	return s.hs.Client()
+}
+
+// testWriter is an io.Writer that logs each write through t.
+type testWriter struct {
+	t testing.TB
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Helper()
+	w.t.Logf("%s", p)
+	return len(p), nil
+}
@@ -0,0 +1,30 @@
+package bastiontest_test
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"filippo.io/litetlog/bastion/bastiontest"
+)
+
+func TestNewServer(t *testing.T) {
+	s := bastiontest.NewServer(t, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.URL.Path)
+	}))
+	resp, err := s.Client().Get(s.URL + "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello from /foo" {
+		t.Errorf("got body %q", body)
+	}
+	if !s.Bastion.IsConnected(s.KeyHash) {
+		t.Error("backend is not connected")
+	}
+}
@@ -0,0 +1,276 @@
+package bastion
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Collector receives events about backend connections and forwarded
+// requests, so that they can be exported as per-backend metrics with any
+// metrics library. See [Config.Collector].
+//
+// The methods of a Collector may be called concurrently.
+type Collector interface {
+	// BackendConnected is called when a backend connection is accepted.
+	// replaced is true if accepting it displaced a live connection of the
+	// same backend, as for [Config.OnBackendConnect].
+	BackendConnected(keyHash [sha256.Size]byte, replaced bool)
+
+	// BackendDisconnected is called when an accepted backend connection is
+	// closed, including when it was replaced by a new one.
+	BackendDisconnected(keyHash [sha256.Size]byte)
+
+	// RequestCompleted is called once the response to a request for a
+	// backend was sent to the client, whether it was forwarded to the backend
+	// or generated by the bastion, for example because the backend is not
+	// connected, the bastion is paused, or the request was rejected by
+	// ClientACL, AllowRequest, or MaxRequestBodyBytes. Responses served by
+	// NoBackendsHandler and redirects of "/<key hash>" are also reported.
+	// Requests that don't name a backend, or that are rejected by
+	// AuthorizeRequest, are not.
+	//
+	// reason is empty if the response came from the backend, and otherwise
+	// it's why the bastion generated it, like "unavailable" or
+	// "rate_limited", as in the bastion_synthesized_responses_total metric of
+	// [Bastion.MetricsHandler]. bytesIn and bytesOut are the sizes of the
+	// request body read from the client and of the response body written to
+	// it.
+	RequestCompleted(keyHash [sha256.Size]byte, status int, reason string, bytesIn, bytesOut int64)
+}
+
+// metrics are the counters exported by [Bastion.MetricsHandler].
+type metrics struct {
+	// rejected counts backend connections that failed verification or were
+	// rejected by handleBackend.
+	rejected atomic.Int64
+	// unusedClosed counts connections closed by UnusedConnectionTimeout.
+	unusedClosed atomic.Int64
+	// backendResponses and bastionResponses count responses received from
+	// backends and generated by the bastion, respectively, by status class,
+	// with index 0 counting status codes outside the 1xx–5xx range.
+	backendResponses [6]atomic.Int64
+	bastionResponses [6]atomic.Int64
+	// synthesized maps the reasons for responses generated by the bastion to
+	// an *atomic.Int64 counter.
+	synthesized sync.Map
+
+	// exactCodes is Config.StatusCodeMetrics. If set, codes maps a
+	// statusCodeKey to an *atomic.Int64 counter.
+	exactCodes bool
+	codes      sync.Map
+
+	// lifetimes is a histogram of the durations of closed backend connections.
+	lifetimes durationHistogram
+}
+
+// lifetimeBuckets are the upper bounds of the buckets of
+// bastion_backend_connection_lifetime_seconds.
+var lifetimeBuckets = []time.Duration{
+	time.Second, 10 * time.Second, time.Minute, 10 * time.Minute,
+	time.Hour, 6 * time.Hour, 24 * time.Hour, 7 * 24 * time.Hour,
+}
+
+// durationHistogram is a histogram of durations over lifetimeBuckets.
+type durationHistogram struct {
+	// buckets counts observations by the index of the smallest bucket they
+	// fit in, with the last element counting those larger than all buckets.
+	buckets [9]atomic.Int64
+	count   atomic.Int64
+	sum     atomic.Int64 // nanoseconds
+}
+
+func (h *durationHistogram) observe(d time.Duration) {
+	i, _ := slices.BinarySearch(lifetimeBuckets, d)
+	h.buckets[i].Add(1)
+	h.sum.Add(int64(d))
+	h.count.Add(1)
+}
+
+func (h *durationHistogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	// Load the count first, so that the cumulative buckets of a concurrent
+	// observation can't exceed it.
+	count := h.count.Load()
+	var cumulative int64
+	for i, le := range lifetimeBuckets {
+		cumulative += h.buckets[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, le.Seconds(), min(cumulative, count))
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, time.Duration(h.sum.Load()).Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+type statusCodeKey struct {
+	origin string
+	code   string
+}
+
+// StatusCodeLabel returns the metric label for an HTTP status code: the code
+// itself, like "404", if it's a standard code known to [http.StatusText], and
+// "other" otherwise. Collectors can use it to bound the cardinality of
+// per-status metrics, like [Bastion.MetricsHandler] does.
+func StatusCodeLabel(status int) string {
+	if http.StatusText(status) == "" {
+		return "other"
+	}
+	return strconv.Itoa(status)
+}
+
+func statusClass(status int) int {
+	if status < 100 || status > 599 {
+		return 0
+	}
+	return status / 100
+}
+
+func (m *metrics) countBackendResponse(status int) {
+	m.backendResponses[statusClass(status)].Add(1)
+	m.countCode("backend", status)
+}
+
+func (m *metrics) countSynthesized(status int, reason string) {
+	m.bastionResponses[statusClass(status)].Add(1)
+	m.countCode("bastion", status)
+	addToCounter(&m.synthesized, reason)
+}
+
+func (m *metrics) countCode(origin string, status int) {
+	if m.exactCodes {
+		addToCounter(&m.codes, statusCodeKey{origin, StatusCodeLabel(status)})
+	}
+}
+
+// addToCounter increments the *atomic.Int64 counter for key in counters,
+// creating it if needed.
+func addToCounter(counters *sync.Map, key any) {
+	n, ok := counters.Load(key)
+	if !ok {
+		n, _ = counters.LoadOrStore(key, new(atomic.Int64))
+	}
+	n.(*atomic.Int64).Add(1)
+}
+
+// responseOrigin records the reason a response was generated by the bastion,
+// if it was, for the Collector. It's stored in the request context by
+// ServeHTTP, and only accessed by the goroutine serving the request.
+type responseOrigin struct {
+	reason string
+}
+
+type responseOriginContextKey struct{}
+
+// synthesized counts a response generated by the bastion for the request with
+// context ctx, and records its reason for the Collector.
+func (p *backendConnectionsPool) synthesized(ctx context.Context, status int, reason string) {
+	p.metrics.countSynthesized(status, reason)
+	if ro, ok := ctx.Value(responseOriginContextKey{}).(*responseOrigin); ok {
+		ro.reason = reason
+	}
+}
+
+// MetricsHandler returns a handler that exposes the bastion's metrics in the
+// Prometheus text exposition format. The exported metrics are
+//
+//   - bastion_backends_connected, a gauge of the live backend connections;
+//   - bastion_backend_connections_accepted_total;
+//   - bastion_backend_connections_rejected_total, counting backends that
+//     were not allowed, or that failed or were refused after the handshake;
+//   - bastion_backend_connections_unused_closed_total, counting connections
+//     closed because of [Config.UnusedConnectionTimeout];
+//   - bastion_requests_total, counting responses, with an "origin" label of
+//     "backend" or "bastion", the latter for responses generated by the
+//     bastion, and a "code" label of "1xx" to "5xx";
+//   - bastion_synthesized_responses_total, counting responses generated by
+//     the bastion by "reason", such as "unavailable" (the backend is not
+//     connected), "unknown_backend", "rate_limited", "concurrency_limited",
+//     "backend_error" (the request could not be forwarded), "timeout", or
+//     "paused";
+//   - bastion_backend_connection_lifetime_seconds, a histogram of how long
+//     backend connections stayed connected, observed when they are closed;
+//   - bastion_responses_by_code_total, if [Config.StatusCodeMetrics] is set,
+//     like bastion_requests_total but with the exact status code, as
+//     returned by [StatusCodeLabel], in the "code" label.
+//
+// This way, the bastion can be scraped without linking a metrics library.
+func (b *Bastion) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := &b.pool.metrics
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetric(w, "bastion_backends_connected", "gauge",
+			"Number of live backend connections.",
+			int64(b.pool.connected()))
+		writeMetric(w, "bastion_backend_connections_accepted_total", "counter",
+			"Backend connections accepted.",
+			int64(b.AcceptedConnections()))
+		writeMetric(w, "bastion_backend_connections_rejected_total", "counter",
+			"Backend connections rejected.",
+			m.rejected.Load())
+		writeMetric(w, "bastion_backend_connections_unused_closed_total", "counter",
+			"Backend connections closed for not serving any request.",
+			m.unusedClosed.Load())
+		fmt.Fprintf(w, "# HELP bastion_requests_total Responses, by origin and status class.\n")
+		fmt.Fprintf(w, "# TYPE bastion_requests_total counter\n")
+		for _, origin := range []struct {
+			name   string
+			counts *[6]atomic.Int64
+		}{{"backend", &m.backendResponses}, {"bastion", &m.bastionResponses}} {
+			for i := range origin.counts {
+				code := "other"
+				if i > 0 {
+					code = fmt.Sprintf("%dxx", i)
+				}
+				fmt.Fprintf(w, "bastion_requests_total{origin=%q,code=%q} %d\n",
+					origin.name, code, origin.counts[i].Load())
+			}
+		}
+		var reasons []string
+		m.synthesized.Range(func(k, _ any) bool {
+			reasons = append(reasons, k.(string))
+			return true
+		})
+		slices.Sort(reasons)
+		fmt.Fprintf(w, "# HELP bastion_synthesized_responses_total Responses generated by the bastion, by reason.\n")
+		fmt.Fprintf(w, "# TYPE bastion_synthesized_responses_total counter\n")
+		for _, reason := range reasons {
+			n, _ := m.synthesized.Load(reason)
+			fmt.Fprintf(w, "bastion_synthesized_responses_total{reason=%q} %d\n", reason, n.(*atomic.Int64).Load())
+		}
+		m.lifetimes.write(w, "bastion_backend_connection_lifetime_seconds",
+			"Duration of closed backend connections.")
+		if !m.exactCodes {
+			return
+		}
+		var codes []statusCodeKey
+		m.codes.Range(func(k, _ any) bool {
+			codes = append(codes, k.(statusCodeKey))
+			return true
+		})
+		slices.SortFunc(codes, func(a, b statusCodeKey) int {
+			return cmp.Or(cmp.Compare(a.origin, b.origin), cmp.Compare(a.code, b.code))
+		})
+		fmt.Fprintf(w, "# HELP bastion_responses_by_code_total Responses, by origin and status code.\n")
+		fmt.Fprintf(w, "# TYPE bastion_responses_by_code_total counter\n")
+		for _, k := range codes {
+			n, _ := m.codes.Load(k)
+			fmt.Fprintf(w, "bastion_responses_by_code_total{origin=%q,code=%q} %d\n",
+				k.origin, k.code, n.(*atomic.Int64).Load())
+		}
+	})
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
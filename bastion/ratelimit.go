@@ -0,0 +1,72 @@
+package bastion
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket rate limiter. The rate and burst are passed to
+// every call, so that they can change between requests.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token from the bucket, refilling it at rate tokens per second
+// up to burst since the last call. If the bucket is empty, take returns false
+// and how long until the next token is available.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+elapsed.Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// requestRate returns the effective rate limit and burst for the configured
+// rate and burst, or zero if requests are not rate limited.
+func requestRate(rate float64, burst int) (float64, int) {
+	if rate <= 0 {
+		return 0, 0
+	}
+	if burst <= 0 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	return rate, burst
+}
+
+// allowRequest applies the request rate limit of backend, if any, and returns
+// false and a Retry-After value if the request should be rejected.
+func (p *backendConnectionsPool) allowRequest(backend keyHash, policy BackendPolicy, now time.Time) (bool, string) {
+	rate, burst := p.c.RequestsPerSecondPerBackend, p.c.RequestBurstPerBackend
+	if policy.RequestsPerSecond != 0 {
+		rate, burst = policy.RequestsPerSecond, policy.RequestBurst
+	}
+	rate, burst = requestRate(rate, burst)
+	if rate == 0 {
+		return true, ""
+	}
+	p.bucketsMu.Lock()
+	b, ok := p.buckets[backend]
+	if !ok {
+		b = &tokenBucket{}
+		p.buckets[backend] = b
+	}
+	p.bucketsMu.Unlock()
+	ok, wait := b.take(now, rate, burst)
+	if ok {
+		return true, ""
+	}
+	return false, strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
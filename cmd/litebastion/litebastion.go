@@ -18,6 +18,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -99,17 +100,6 @@ func main() {
 		log.Fatalf("failed to load backends: %v", err)
 	}
 	log.Printf("loaded %d backends", len(allowedBackends))
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP)
-	go func() {
-		for range c {
-			if err := reloadBackends(); err != nil {
-				log.Printf("failed to reload backends: %v", err)
-			} else {
-				log.Printf("reloaded backends")
-			}
-		}
-	}()
 
 	b, err := bastion.New(&bastion.Config{
 		AllowedBackend: func(keyHash [sha256.Size]byte) bool {
@@ -118,11 +108,25 @@ func main() {
 			return allowedBackends[keyHash]
 		},
 		GetCertificate: getCertificate,
+		Logger:         slog.Default(),
 	})
 	if err != nil {
 		log.Fatalf("failed to load bastion: %v", err)
 	}
 
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			if err := reloadBackends(); err != nil {
+				log.Printf("failed to reload backends: %v", err)
+			} else {
+				log.Printf("reloaded backends")
+				b.RecheckAllowedBackends()
+			}
+		}
+	}()
+
 	hs := &http.Server{
 		Addr:         *listenAddr,
 		Handler:      http.MaxBytesHandler(b, 10*1024),
@@ -141,15 +145,23 @@ func main() {
 	}
 
 	log.Printf("listening on %s", *listenAddr)
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 	e := make(chan error, 1)
 	go func() { e <- hs.ListenAndServeTLS("", "") }()
 	select {
 	case <-ctx.Done():
+		log.Printf("shutting down")
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
+		// Backend connections are not tracked by http.Server after the
+		// handoff to the bastion, so they need to be drained separately.
+		drained := make(chan error, 1)
+		go func() { drained <- b.Shutdown(ctx) }()
 		hs.Shutdown(ctx)
+		if err := <-drained; err != nil {
+			log.Printf("backend connections not drained: %v", err)
+		}
 	case err := <-e:
 		log.Fatalf("server error: %v", err)
 	}
@@ -4,18 +4,13 @@ import (
 	"context"
 	"crypto"
 	"crypto/ed25519"
-	"crypto/rand"
 	"crypto/sha256"
-	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/hex"
 	"errors"
 	"flag"
-	"fmt"
 	"io"
 	"log/slog"
-	"math/big"
 	"net"
 	"net/http"
 	"os"
@@ -25,8 +20,8 @@ import (
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/net/http2"
 
+	"filippo.io/litetlog/bastion/bastionclient"
 	"filippo.io/litetlog/internal/witness"
 )
 
@@ -168,12 +163,6 @@ func (s *signer) Sign(rand io.Reader, data []byte, opts crypto.SignerOpts) (sign
 var errBastionDisconnected = errors.New("connection to bastion interrupted")
 
 func connectToBastion(ctx context.Context, bastion string, signer *signer, srv *http.Server) error {
-	cert, err := selfSignedCertificate(signer)
-	if err != nil {
-		fatal("generating self-signed certificate", "err", err)
-	}
-	dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
 	var roots *x509.CertPool
 	if *testCertFlag {
 		roots = x509.NewCertPool()
@@ -183,50 +172,20 @@ func connectToBastion(ctx context.Context, bastion string, signer *signer, srv *
 		}
 		roots.AppendCertsFromPEM(root)
 	}
-	conn, err := (&tls.Dialer{
-		Config: &tls.Config{
-			Certificates: []tls.Certificate{{
-				Certificate: [][]byte{cert},
-				PrivateKey:  signer,
-			}},
-			MinVersion: tls.VersionTLS13,
-			MaxVersion: tls.VersionTLS13,
-			NextProtos: []string{"bastion/0"},
-			RootCAs:    roots,
-		},
-	}).DialContext(dialCtx, "tcp", bastion)
+	conn, err := bastionclient.Dial(ctx, bastion, &bastionclient.Config{
+		Key:     signer,
+		RootCAs: roots,
+	})
 	if err != nil {
-		return fmt.Errorf("connecting to bastion: %v", err)
+		return err
 	}
 	slog.Info("connected to bastion", "bastion", bastion)
 	// TODO: find a way to surface the fatal error, especially since with
 	// TLS 1.3 it might be that the bastion rejected the client certificate.
-	(&http2.Server{
-		CountError: func(errType string) {
-			if http2.VerboseLogs {
-				slog.Debug("HTTP/2 server error", "type", errType)
-			}
-		},
-	}).ServeConn(conn, &http2.ServeConnOpts{
-		Context:    ctx,
-		BaseConfig: srv,
-		Handler:    srv.Handler,
-	})
+	bastionclient.ServeConn(ctx, conn, srv)
 	return errBastionDisconnected
 }
 
-func selfSignedCertificate(key crypto.Signer) ([]byte, error) {
-	tmpl := &x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject:      pkix.Name{CommonName: "litewitness"},
-		NotBefore:    time.Now().Add(-1 * time.Hour),
-		NotAfter:     time.Now().Add(24 * time.Hour),
-		KeyUsage:     x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
-	}
-	return x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
-}
-
 func fatal(msg string, args ...any) {
 	slog.Error(msg, args...)
 	os.Exit(1)
@@ -51,7 +51,8 @@ func TestScript(t *testing.T) {
 						t := http.DefaultTransport.(*http.Transport).Clone()
 						t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 						r, err := (&http.Client{Transport: t}).Get(args[0])
-						if err == nil && r.StatusCode != http.StatusBadGateway {
+						if err == nil && r.StatusCode != http.StatusBadGateway &&
+							r.StatusCode != http.StatusServiceUnavailable {
 							return
 						}
 						time.Sleep(100 * time.Millisecond)